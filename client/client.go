@@ -0,0 +1,441 @@
+// Package client reads maps built by moredis.  A map's name holds a reference to the hash
+// that currently stores its entries, and moredis deletes the old hash when it swaps in a
+// new one.  The client resolves the reference and reads the hash in a single script call,
+// so that reads never see a hash that has been swapped out.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrNoMap is returned when a map has not been built.
+	ErrNoMap = errors.New("map does not exist")
+	// ErrMapSwapped is returned by Scan when the map is swapped to a new hash part way
+	// through the scan.
+	ErrMapSwapped = errors.New("map was swapped during scan")
+)
+
+// lookupSource resolves the map named by KEYS[1] and returns its hash key followed by the
+// values of the fields in ARGV, or false if the map doesn't exist.
+const lookupSource = `
+local hash = redis.call('GET', KEYS[1])
+if not hash then
+  return false
+end
+local result = redis.call('HMGET', hash, unpack(ARGV))
+table.insert(result, 1, hash)
+return result
+`
+
+var lookupScript = redis.NewScript(1, lookupSource)
+
+// cachedLookupSource returns the values of the fields in ARGV from the hash KEYS[1], or
+// false if the hash no longer exists because its map has been swapped.
+const cachedLookupSource = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return false
+end
+return redis.call('HMGET', KEYS[1], unpack(ARGV))
+`
+
+var cachedLookupScript = redis.NewScript(1, cachedLookupSource)
+
+// scanSource returns a page of the hash for the map named by KEYS[1], as its hash key,
+// the next cursor, and the field/value pairs.  ARGV holds the hash key, which is empty
+// for the first page, the cursor and the page size.  It returns false if the map doesn't
+// exist, or if the hash no longer exists for later pages.
+const scanSource = `
+local hash = ARGV[1]
+if hash == '' then
+  hash = redis.call('GET', KEYS[1])
+  if not hash then
+    return false
+  end
+elseif redis.call('EXISTS', hash) == 0 then
+  return false
+end
+local page = redis.call('HSCAN', hash, ARGV[2], 'COUNT', ARGV[3])
+return {hash, page[1], page[2]}
+`
+
+var scanScript = redis.NewScript(1, scanSource)
+
+// entitySource resolves the entity map named by KEYS[1] and returns the fields of the
+// entity with the key ARGV[1], or false if the map doesn't exist.  Entity keys are formed
+// as by moredis.EntityKey.
+const entitySource = `
+local hash = redis.call('GET', KEYS[1])
+if not hash then
+  return false
+end
+return redis.call('HGETALL', hash .. ':entity:' .. ARGV[1])
+`
+
+var entityScript = redis.NewScript(1, entitySource)
+
+// Pool is a source of redis connections, such as a *redis.Pool.
+type Pool interface {
+	Get() redis.Conn
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithPointerCache caches the hash key each map refers to for ttl, saving redis the
+// lookup of the map's reference.  Reads from a cached hash that has been swapped out are
+// retried with the map's new hash, so the Client's reads never return stale values; use
+// Watch to update it as soon as maps are swapped.  Callers that cache values by the hash
+// key Resolve returns only see swaps through Watch, so should always use it.
+func WithPointerCache(ttl time.Duration) Option {
+	return func(c *Client) {
+		c.ttl = ttl
+	}
+}
+
+// WithScanCount sets the number of entries Scan asks redis for at a time.  The default
+// is 100.
+func WithScanCount(count int) Option {
+	return func(c *Client) {
+		if count > 0 {
+			c.scanCount = count
+		}
+	}
+}
+
+// Client reads the entries of moredis maps.  It is safe for concurrent use.
+type Client struct {
+	pool      Pool
+	ttl       time.Duration
+	scanCount int
+	now       func() time.Time
+
+	mu       sync.Mutex
+	pointers map[string]pointer
+}
+
+// pointer is a cached map reference.
+type pointer struct {
+	hashKey string
+	expires time.Time
+}
+
+// New creates a Client that reads from connections from pool.
+func New(pool Pool, options ...Option) *Client {
+	c := &Client{
+		pool:      pool,
+		scanCount: 100,
+		now:       time.Now,
+		pointers:  map[string]pointer{},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Lookup returns the value of key in the map mapName.  The bool result is false if the
+// map has no entry for key.  ErrNoMap is returned if the map doesn't exist.
+func (c *Client) Lookup(ctx context.Context, mapName, key string) (string, bool, error) {
+	values, err := c.LookupMany(ctx, mapName, []string{key})
+	if err != nil {
+		return "", false, err
+	}
+	val, ok := values[key]
+	return val, ok, nil
+}
+
+// LookupMany returns the values of keys in the map mapName.  Keys that the map has no
+// entry for are left out of the result.  ErrNoMap is returned if the map doesn't exist.
+func (c *Client) LookupMany(ctx context.Context, mapName string, keys []string) (map[string]string, error) {
+	_, values, err := c.LookupManyIn(ctx, mapName, keys)
+	return values, err
+}
+
+// LookupManyIn is LookupMany, but also returns the key of the hash the values were read
+// from, which identifies the build of the map they came from.  The hash key is empty if
+// keys is empty.
+func (c *Client) LookupManyIn(ctx context.Context, mapName string, keys []string) (string, map[string]string, error) {
+	values := map[string]string{}
+	if len(keys) == 0 {
+		return "", values, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	fields := make([]interface{}, len(keys))
+	for ix, key := range keys {
+		fields[ix] = key
+	}
+	hashKey, cached := c.cachedPointer(mapName)
+	var reply []interface{}
+	if cached {
+		var err error
+		reply, err = redis.Values(cachedLookupScript.Do(conn, append([]interface{}{hashKey}, fields...)...))
+		if err != nil && err != redis.ErrNil {
+			return "", nil, err
+		}
+		if err == redis.ErrNil {
+			// the map was swapped since the pointer was cached
+			c.Invalidate(mapName)
+			reply = nil
+		}
+	}
+	if reply == nil {
+		resolved, err := redis.Values(lookupScript.Do(conn, append([]interface{}{mapName}, fields...)...))
+		if err == redis.ErrNil {
+			return "", nil, ErrNoMap
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if hashKey, err = redis.String(resolved[0], nil); err != nil {
+			return "", nil, err
+		}
+		c.cachePointer(mapName, hashKey)
+		reply = resolved[1:]
+	}
+
+	for ix, key := range keys {
+		if reply[ix] == nil {
+			continue
+		}
+		val, err := redis.String(reply[ix], nil)
+		if err != nil {
+			return "", nil, err
+		}
+		values[key] = val
+	}
+	return hashKey, values, nil
+}
+
+// Entity returns the fields of the entity with the given key in the entity map mapName.
+// The bool result is false if the map has no such entity.  ErrNoMap is returned if the
+// map doesn't exist.
+func (c *Client) Entity(ctx context.Context, mapName, key string) (map[string]string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(entityScript.Do(conn, mapName, key))
+	if err == redis.ErrNil {
+		return nil, false, ErrNoMap
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return fields, len(fields) > 0, nil
+}
+
+// Resolve returns the key of the hash that the map mapName currently refers to, using the
+// cached pointer if there is one.  ErrNoMap is returned if the map doesn't exist.
+func (c *Client) Resolve(ctx context.Context, mapName string) (string, error) {
+	if hashKey, ok := c.cachedPointer(mapName); ok {
+		return hashKey, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	hashKey, err := redis.String(conn.Do("GET", mapName))
+	if err == redis.ErrNil {
+		return "", ErrNoMap
+	}
+	if err != nil {
+		return "", err
+	}
+	c.cachePointer(mapName, hashKey)
+	return hashKey, nil
+}
+
+// Scan calls fn with each entry in the map mapName, stopping at the first error fn
+// returns.  All of the entries come from the same build of the map; if the map is swapped
+// during the scan, Scan stops and returns ErrMapSwapped.  Entries can be passed to fn more
+// than once, as with HSCAN.
+func (c *Client) Scan(ctx context.Context, mapName string, fn func(key, val string) error) error {
+	scanner := c.NewScanner(mapName)
+	for {
+		entries, err := scanner.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if entries == nil {
+			return nil
+		}
+		for _, entry := range entries {
+			if err := fn(entry.Key, entry.Value); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Entry is an entry in a map.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Scanner reads the entries of a map a page at a time, with the same guarantees as Scan.
+// It is not safe for concurrent use.
+type Scanner struct {
+	c       *Client
+	mapName string
+	hashKey string
+	cursor  string
+	done    bool
+}
+
+// NewScanner creates a Scanner for the entries of the map mapName.
+func (c *Client) NewScanner(mapName string) *Scanner {
+	return &Scanner{c: c, mapName: mapName, cursor: "0"}
+}
+
+// HashKey returns the key of the hash being scanned, which is empty until the first page
+// has been read.
+func (s *Scanner) HashKey() string {
+	return s.hashKey
+}
+
+// Next returns the next page of entries.  It returns no entries and no error once all of
+// the entries have been read.  ErrNoMap is returned if the map doesn't exist, and
+// ErrMapSwapped if it is swapped part way through the scan.
+func (s *Scanner) Next(ctx context.Context) ([]Entry, error) {
+	conn := s.c.pool.Get()
+	defer conn.Close()
+	// HSCAN can return empty pages before the end of the hash
+	for !s.done {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reply, err := redis.Values(scanScript.Do(conn, s.mapName, s.hashKey, s.cursor, s.c.scanCount))
+		if err == redis.ErrNil {
+			if s.hashKey == "" {
+				return nil, ErrNoMap
+			}
+			return nil, ErrMapSwapped
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.hashKey, err = redis.String(reply[0], nil); err != nil {
+			return nil, err
+		}
+		if s.cursor, err = redis.String(reply[1], nil); err != nil {
+			return nil, err
+		}
+		fields, err := redis.Strings(reply[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		s.done = s.cursor == "0"
+		if len(fields) < 2 {
+			continue
+		}
+		entries := make([]Entry, 0, len(fields)/2)
+		for ix := 0; ix+1 < len(fields); ix += 2 {
+			entries = append(entries, Entry{Key: fields[ix], Value: fields[ix+1]})
+		}
+		return entries, nil
+	}
+	return nil, nil
+}
+
+// Invalidate removes any cached pointer for mapName, so that the next lookup resolves the
+// map's reference.
+func (c *Client) Invalidate(mapName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pointers, mapName)
+}
+
+// dropPointers removes all of the cached pointers.
+func (c *Client) dropPointers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pointers = map[string]pointer{}
+}
+
+// Watch subscribes to the channel moredis publishes swap notifications on, and updates
+// the cached pointer for each map as it is swapped.  It blocks until ctx is done or the
+// subscription fails, and closes conn when it returns.  conn must not be used for
+// anything else.  Swaps can be missed while Watch isn't subscribed, so the cached
+// pointers are dropped once it subscribes, and again if the subscription fails.
+func (c *Client) Watch(ctx context.Context, conn redis.Conn, channel string) error {
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Message:
+			var swap struct {
+				Map        string `json:"map"`
+				NewHashKey string `json:"new_hash_key"`
+			}
+			if err := json.Unmarshal(msg.Data, &swap); err != nil || swap.Map == "" {
+				continue
+			}
+			c.cachePointer(swap.Map, swap.NewHashKey)
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return ctx.Err()
+			}
+			if msg.Kind == "subscribe" {
+				c.dropPointers()
+			}
+		case error:
+			c.dropPointers()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return msg
+		}
+	}
+}
+
+// cachedPointer returns the cached hash key for mapName, if there is an unexpired one.
+func (c *Client) cachedPointer(mapName string) (string, bool) {
+	if c.ttl <= 0 {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pointers[mapName]
+	if !ok || c.now().After(p.expires) {
+		return "", false
+	}
+	return p.hashKey, true
+}
+
+// cachePointer caches hashKey as the hash for mapName, if pointers are cached.
+func (c *Client) cachePointer(mapName, hashKey string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pointers[mapName] = pointer{hashKey: hashKey, expires: c.now().Add(c.ttl)}
+}
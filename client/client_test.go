@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPool struct{}
+
+func (testPool) Get() redis.Conn { return redigomock.NewConn() }
+
+// mockScript sets up the reply for a script called with keysAndArgs.  The EVALSHA for
+// every script fails, so that scripts are run with EVAL.
+func mockScript(source string, keysAndArgs ...interface{}) *redigomock.Cmd {
+	return redigomock.Command("EVAL", append([]interface{}{source, 1}, keysAndArgs...)...)
+}
+
+func setupMocks() {
+	redigomock.Clear()
+	redigomock.GenericCommand("EVALSHA").ExpectError(redis.Error("NOSCRIPT No matching script"))
+}
+
+func TestLookup(t *testing.T) {
+	setupMocks()
+	mockScript(lookupSource, "users", "a").Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice")})
+	mockScript(lookupSource, "users", "b").Expect([]interface{}{[]byte("moredis:maps:1"), nil})
+	mockScript(lookupSource, "nope", "a").ExpectError(redis.ErrNil)
+	c := New(testPool{})
+
+	val, ok, err := c.Lookup(context.Background(), "users", "a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", val)
+
+	_, ok, err = c.Lookup(context.Background(), "users", "b")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = c.Lookup(context.Background(), "nope", "a")
+	assert.Equal(t, ErrNoMap, err)
+}
+
+func TestLookupMany(t *testing.T) {
+	setupMocks()
+	mockScript(lookupSource, "users", "a", "b", "c").
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice"), nil, []byte("carol")})
+	c := New(testPool{})
+
+	values, err := c.LookupMany(context.Background(), "users", []string{"a", "b", "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "alice", "c": "carol"}, values)
+
+	values, err = c.LookupMany(context.Background(), "users", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.LookupMany(ctx, "users", []string{"a"})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestLookupPointerCache(t *testing.T) {
+	setupMocks()
+	mockScript(lookupSource, "users", "a").Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice")})
+	mockScript(cachedLookupSource, "moredis:maps:1", "a").Expect([]interface{}{[]byte("cached")})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(testPool{}, WithPointerCache(time.Minute))
+	c.now = func() time.Time { return now }
+
+	// the first lookup resolves the reference, and later ones use the cached pointer
+	val, _, err := c.Lookup(context.Background(), "users", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", val)
+	val, _, err = c.Lookup(context.Background(), "users", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", val)
+
+	// expired pointers are resolved again
+	now = now.Add(2 * time.Minute)
+	val, _, err = c.Lookup(context.Background(), "users", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", val)
+
+	// a swapped out hash is resolved again
+	c.cachePointer("users", "moredis:maps:0")
+	mockScript(cachedLookupSource, "moredis:maps:0", "a").ExpectError(redis.ErrNil)
+	val, _, err = c.Lookup(context.Background(), "users", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", val)
+	hashKey, ok := c.cachedPointer("users")
+	assert.True(t, ok)
+	assert.Equal(t, "moredis:maps:1", hashKey)
+
+	c.Invalidate("users")
+	_, ok = c.cachedPointer("users")
+	assert.False(t, ok)
+}
+
+func TestScan(t *testing.T) {
+	setupMocks()
+	mockScript(scanSource, "users", "", "0", 2).
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("7"), []interface{}{[]byte("a"), []byte("alice"), []byte("b"), []byte("bob")}})
+	mockScript(scanSource, "users", "moredis:maps:1", "7", 2).
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("0"), []interface{}{[]byte("c"), []byte("carol")}})
+	c := New(testPool{}, WithScanCount(2))
+
+	entries := map[string]string{}
+	err := c.Scan(context.Background(), "users", func(key, val string) error {
+		entries[key] = val
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "alice", "b": "bob", "c": "carol"}, entries)
+
+	stop := errors.New("stop")
+	err = c.Scan(context.Background(), "users", func(key, val string) error { return stop })
+	assert.Equal(t, stop, err)
+
+	mockScript(scanSource, "nope", "", "0", 2).ExpectError(redis.ErrNil)
+	assert.Equal(t, ErrNoMap, c.Scan(context.Background(), "nope", nil))
+}
+
+func TestScanSwapped(t *testing.T) {
+	setupMocks()
+	mockScript(scanSource, "users", "", "0", 100).
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("7"), []interface{}{[]byte("a"), []byte("alice")}})
+	mockScript(scanSource, "users", "moredis:maps:1", "7", 100).ExpectError(redis.ErrNil)
+	c := New(testPool{})
+
+	err := c.Scan(context.Background(), "users", func(key, val string) error { return nil })
+	assert.Equal(t, ErrMapSwapped, err)
+}
+
+func TestResolve(t *testing.T) {
+	setupMocks()
+	redigomock.Command("GET", "users").Expect([]byte("moredis:maps:1"))
+	redigomock.Command("GET", "nope").ExpectError(redis.ErrNil)
+	c := New(testPool{})
+
+	hashKey, err := c.Resolve(context.Background(), "users")
+	assert.NoError(t, err)
+	assert.Equal(t, "moredis:maps:1", hashKey)
+	_, err = c.Resolve(context.Background(), "nope")
+	assert.Equal(t, ErrNoMap, err)
+
+	c = New(testPool{}, WithPointerCache(time.Minute))
+	c.cachePointer("users", "moredis:maps:2")
+	hashKey, err = c.Resolve(context.Background(), "users")
+	assert.NoError(t, err)
+	assert.Equal(t, "moredis:maps:2", hashKey)
+}
+
+func TestWatchDropsPointers(t *testing.T) {
+	setupMocks()
+	redigomock.Command("SUBSCRIBE", "moredis:swaps").Expect([]interface{}{[]byte("subscribe"), []byte("moredis:swaps"), int64(1)})
+	c := New(testPool{}, WithPointerCache(time.Minute))
+	c.cachePointer("users", "moredis:maps:1")
+
+	// swaps made before the subscription, or after it drops, may have been missed
+	err := c.Watch(context.Background(), redigomock.NewConn(), "moredis:swaps")
+	assert.Error(t, err)
+	_, ok := c.cachedPointer("users")
+	assert.False(t, ok)
+}
+
+func TestScanner(t *testing.T) {
+	setupMocks()
+	mockScript(scanSource, "users", "", "0", 2).
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("7"), []interface{}{}})
+	mockScript(scanSource, "users", "moredis:maps:1", "7", 2).
+		Expect([]interface{}{[]byte("moredis:maps:1"), []byte("0"), []interface{}{[]byte("a"), []byte("alice")}})
+	scanner := New(testPool{}, WithScanCount(2)).NewScanner("users")
+
+	entries, err := scanner.Next(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "a", Value: "alice"}}, entries)
+	assert.Equal(t, "moredis:maps:1", scanner.HashKey())
+	entries, err = scanner.Next(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, entries)
+}
+
+func TestEntity(t *testing.T) {
+	setupMocks()
+	mockScript(entitySource, "user", "1").Expect([]interface{}{[]byte("email"), []byte("a@x.com"), []byte("name"), []byte("alice")})
+	mockScript(entitySource, "user", "2").Expect([]interface{}{})
+	mockScript(entitySource, "nope", "1").ExpectError(redis.ErrNil)
+	c := New(testPool{})
+
+	fields, ok, err := c.Entity(context.Background(), "user", "1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"email": "a@x.com", "name": "alice"}, fields)
+	_, ok, err = c.Entity(context.Background(), "user", "2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, _, err = c.Entity(context.Background(), "nope", "1")
+	assert.Equal(t, ErrNoMap, err)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/Clever/moredis/client"
 	"github.com/Clever/moredis/logger"
 	"github.com/Clever/moredis/moredis"
+	"github.com/garyburd/redigo/redis"
 )
 
 // Default database connection parameters
@@ -15,13 +22,43 @@ const (
 	DefaultRedisURL = "localhost:6379"
 )
 
+// DefaultMetricsAddr is the address the /metrics endpoint listens on in daemon mode.
+const DefaultMetricsAddr = ":9100"
+
+// DefaultListenAddr is the address the serve command listens on.
+const DefaultListenAddr = ":8080"
+
 var (
 	redisURL       string
+	redisURLFile   string
 	mongoURL       string
+	mongoURLFile   string
 	params         moredis.Params
 	configFilePath string
+	interval       time.Duration
+	metricsAddr    string
+	pushURL        string
+	reportFormat   string
+	cacheNames     stringList
+	mapNames       stringList
+	listenAddr     string
+	cacheSize      int
+	pointerTTL     time.Duration
+	notifyChannel  string
 )
 
+// stringList is a flag that can be given more than once, or as a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
 func init() {
 	const (
 		defaultFilePath = "./config.yml"
@@ -31,44 +68,269 @@ func init() {
 	flag.StringVar(&redisURL, "r", "", "")
 	flag.StringVar(&mongoURL, "mongo_url", "", "")
 	flag.StringVar(&mongoURL, "m", "", "")
+	flag.StringVar(&redisURLFile, "redis_url_file", "", "")
+	flag.StringVar(&mongoURLFile, "mongo_url_file", "", "")
 	flag.Var(&params, "params", "")
 	flag.Var(&params, "p", "")
 	flag.StringVar(&configFilePath, "conf_file", defaultFilePath, "")
 	flag.StringVar(&configFilePath, "f", defaultFilePath, "")
+	flag.DurationVar(&interval, "interval", 0, "")
+	flag.StringVar(&metricsAddr, "metrics_addr", DefaultMetricsAddr, "")
+	flag.StringVar(&pushURL, "push_url", "", "")
+	flag.StringVar(&reportFormat, "report", "", "")
+	flag.Var(&cacheNames, "cache", "")
+	flag.Var(&mapNames, "map", "")
+	flag.StringVar(&listenAddr, "listen", DefaultListenAddr, "")
+	flag.IntVar(&cacheSize, "cache_size", 10000, "")
+	flag.DurationVar(&pointerTTL, "pointer_ttl", 0, "")
+	flag.StringVar(&notifyChannel, "notify_channel", "", "")
 }
 
 func main() {
 	flag.Usage = PrintUsage
-	flag.Parse()
+	// the first argument may name a command, with flags following it
+	command, args := "build", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
-	// grab connection from env or default if not in flags
+	// grab connection from files, env or default if not in flags
+	var err error
+	if mongoURL, err = FlagFileOrValue(mongoURL, mongoURLFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if redisURL, err = FlagFileOrValue(redisURL, redisURLFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	mongoURL = FlagEnvOrDefault(mongoURL, "MONGO_URL", DefaultMongoURL)
 	redisURL = FlagEnvOrDefault(redisURL, "REDIS_URL", DefaultRedisURL)
 
-	conf, err := moredis.LoadConfig(configFilePath)
+	switch command {
+	case "build":
+		runBuild()
+	case "info":
+		runInfo(flag.Args())
+	case "validate":
+		runValidate()
+	case "serve":
+		runServe()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+		PrintUsage()
+		os.Exit(1)
+	}
+}
+
+// runBuild builds the caches described by the config file, either once or repeatedly
+// in daemon mode.
+func runBuild() {
+	if reportFormat != "" && reportFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown report format %q\n", reportFormat)
+		os.Exit(1)
+	}
+	confs, err := moredis.LoadConfigs(configFilePath)
 	if err != nil {
 		logger.Error("Error loading config.", err)
 		os.Exit(1)
 	}
+	confs, err = moredis.FilterConfigs(confs, params, cacheNames, mapNames)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if interval > 0 {
+		runDaemon(confs)
+		return
+	}
+
+	failed := false
+	for _, conf := range confs {
+		report, err := moredis.BuildCache(conf, params, redisURL, mongoURL)
+		printReport(report)
+		if pushURL != "" {
+			if err := moredis.PushMetrics(pushURL, "moredis", conf.Name); err != nil {
+				logger.Error("Failed to push metrics", err)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runDaemon rebuilds the caches every interval, serving metrics on metricsAddr.  Failed
+// builds are logged and retried on the next tick rather than exiting.
+func runDaemon(confs []moredis.Config) {
+	http.Handle("/metrics", moredis.MetricsHandler())
+	go func() {
+		if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+			logger.Error("Metrics server failed", err)
+			os.Exit(1)
+		}
+	}()
+	logger.Info("Running as daemon", logger.M{"interval": interval.String(), "metrics_addr": metricsAddr})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, conf := range confs {
+			report, err := moredis.BuildCache(conf, params, redisURL, mongoURL)
+			printReport(report)
+			if err != nil {
+				logger.Error("Failed to build cache", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// printReport writes the build report to stdout in the format given by the -report flag.
+func printReport(report moredis.BuildReport) {
+	if reportFormat != "json" {
+		return
+	}
+	out, err := json.Marshal(report)
+	if err != nil {
+		logger.Error("Failed to marshal build report", err)
+		return
+	}
+	fmt.Println(string(out))
+}
+
+// runValidate checks the config file, printing any problems found with it.
+func runValidate() {
+	errs, err := moredis.ValidateConfig(configFilePath, params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", configFilePath)
+}
+
+// runServe serves lookups of the maps in redis over HTTP until the process is killed.
+func runServe() {
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return moredis.DialRedis(redisURL)
+		},
+	}
+	defer pool.Close()
+	if pointerTTL > 0 && notifyChannel == "" {
+		// cached entries are served without asking redis once the pointer is cached, so
+		// without notifications they would outlive a swap until the pointer expires
+		fmt.Fprintln(os.Stderr, "serve requires -notify_channel when -pointer_ttl is set")
+		os.Exit(1)
+	}
+	server := moredis.NewServer(pool, cacheSize, client.WithPointerCache(pointerTTL))
+
+	if pointerTTL > 0 {
+		// keep cached pointers up to date, resubscribing if the connection drops
+		go func() {
+			for {
+				conn, err := moredis.DialRedis(redisURL)
+				if err == nil {
+					err = server.Client().Watch(context.Background(), conn, notifyChannel)
+					conn.Close()
+				}
+				if err != nil {
+					logger.Error("Swap notification subscription failed", err)
+				}
+				time.Sleep(time.Second)
+			}
+		}()
+	}
+
+	logger.Info("Serving maps", logger.M{"listen": listenAddr, "cache_size": cacheSize})
+	if err := http.ListenAndServe(listenAddr, server); err != nil {
+		logger.Error("Server failed", err)
+		os.Exit(1)
+	}
+}
 
-	if err := moredis.BuildCache(conf, params, redisURL, mongoURL); err != nil {
-		fmt.Fprint(os.Stderr, err)
+// runInfo prints the metadata of each of the named maps as JSON.
+func runInfo(mapNames []string) {
+	if len(mapNames) == 0 {
+		fmt.Fprintln(os.Stderr, "info requires at least one map name")
+		os.Exit(1)
+	}
+	redisConn, err := moredis.DialRedis(redisURL)
+	if err != nil {
+		logger.Error("Failed to connect to redis", err)
 		os.Exit(1)
 	}
+	defer redisConn.Close()
+
+	for _, mapName := range mapNames {
+		meta, err := moredis.GetMapMetadata(redisConn, mapName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		out, err := json.MarshalIndent(meta, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	}
 }
 
 // PrintUsage is used to replace flag.Usage, which is pretty terrible.
 func PrintUsage() {
 	var usage = `Usage of ./moredis:
+  ./moredis [flags]                 Build the caches described by the config file
+  ./moredis info [flags] <map>...   Print the metadata of the named maps
+  ./moredis validate [flags]        Check the config file for errors, using -params as sample params
+  ./moredis serve [flags]           Serve lookups of the maps in redis over HTTP
+
+Flags:
   -m, -mongo_url    MongoDB URL, can also be set via the MONGO_URL environment variable
   -p, -params       JSON object with params used for substitution into queries and collection names in config.yml
   -r, -redis_url    Redis URL, can also be set via the REDIS_URL environment variable
+  -mongo_url_file   File to read the MongoDB URL from, e.g. a mounted secret
+  -redis_url_file   File to read the Redis URL from
   -f, -conf_file    Config file, defaults to ./config.yml
+  -interval         Run as a daemon, rebuilding the cache at this interval (e.g. 10m)
+  -metrics_addr     Address to serve /metrics on in daemon mode, defaults to :9100
+  -push_url         Pushgateway URL to push metrics to after a one-shot run
+  -report           Print a report of each build to stdout in the given format (json)
+  -cache            Only build the named cache; can be repeated or comma separated
+  -map              Only build the named map; can be repeated or comma separated
+  -listen           Address for serve to listen on, defaults to :8080
+  -cache_size       Number of map entries serve caches in memory, defaults to 10000
+  -pointer_ttl      How long serve caches the hash each map refers to, defaults to 0 (not cached)
+  -notify_channel   Swap notification channel that serve watches to update cached pointers;
+                    required with -pointer_ttl
   -h, -help         Print this usage message
 `
 	fmt.Fprint(os.Stderr, usage)
 }
 
+// FlagFileOrValue takes in the value returned from flag parsing and the path given to the
+// corresponding file flag.  If the flag was not set, it reads the value from the file.
+func FlagFileOrValue(flagVal, path string) (string, error) {
+	if flagVal != "" || path == "" {
+		return flagVal, nil
+	}
+	return moredis.ReadSecretFile(path)
+}
+
 // FlagEnvOrDefault takes in the value returned from flag parsing, and environment variable to check, and a default value.
 // If the flag was not set, it tries to retrieve the value from environment variables.  If it is not found there it returns
 // the default value.
@@ -0,0 +1,119 @@
+package moredis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of aggregate map, for MapConfig.Aggregate.
+const (
+	// AggregateCount counts the entries for each key.
+	AggregateCount = "count"
+	// AggregateSum sums the values for each key.
+	AggregateSum = "sum"
+	// AggregateMin keeps the lowest value for each key.
+	AggregateMin = "min"
+	// AggregateMax keeps the highest value for each key.
+	AggregateMax = "max"
+	// AggregateDistinctCount counts the distinct values for each key.
+	AggregateDistinctCount = "distinct_count"
+)
+
+var aggregateKinds = []string{AggregateCount, AggregateSum, AggregateMin, AggregateMax, AggregateDistinctCount}
+
+// checkAggregate checks that kind is a kind of aggregate map, or empty.
+func checkAggregate(kind string) error {
+	if kind == "" {
+		return nil
+	}
+	for _, known := range aggregateKinds {
+		if kind == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown aggregate %q, must be one of %s", kind, strings.Join(aggregateKinds, ", "))
+}
+
+// aggregator accumulates the values of an aggregate map's entries in memory, by key, for
+// the entries to be written once all of the documents have been processed.  Each build
+// writes its own hash, so builds running at the same time never mix their values.
+type aggregator struct {
+	kind   string
+	values map[string]*aggregateValue
+}
+
+// aggregateValue is the value accumulated for a key.
+type aggregateValue struct {
+	count int
+	sum   float64
+	// best is the lowest or highest value so far, and bestNum its numeric value if all of
+	// the values so far are numbers
+	best     string
+	bestNum  float64
+	numeric  bool
+	distinct map[string]struct{}
+}
+
+func newAggregator(kind string) *aggregator {
+	return &aggregator{kind: kind, values: map[string]*aggregateValue{}}
+}
+
+// add adds val to the value accumulated for key.  It returns false if val can't be
+// aggregated, e.g. summing a value that isn't a number.
+func (a *aggregator) add(key, val string) bool {
+	num, numErr := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if a.kind == AggregateSum && numErr != nil {
+		return false
+	}
+	acc, ok := a.values[key]
+	if !ok {
+		acc = &aggregateValue{best: val, bestNum: num, numeric: numErr == nil}
+		if a.kind == AggregateDistinctCount {
+			acc.distinct = map[string]struct{}{}
+		}
+		a.values[key] = acc
+	}
+	acc.count++
+	switch a.kind {
+	case AggregateSum:
+		acc.sum += num
+	case AggregateDistinctCount:
+		acc.distinct[val] = struct{}{}
+	case AggregateMin, AggregateMax:
+		// numbers are compared as numbers, anything else (e.g. RFC3339 dates) as strings
+		acc.numeric = acc.numeric && numErr == nil
+		var less bool
+		if acc.numeric {
+			less = num < acc.bestNum
+		} else {
+			less = val < acc.best
+		}
+		if less == (a.kind == AggregateMin) && val != acc.best {
+			acc.best, acc.bestNum = val, num
+		}
+	}
+	return true
+}
+
+// entries returns the accumulated value for each key, sorted by key.
+func (a *aggregator) entries() []Entry {
+	entries := make([]Entry, 0, len(a.values))
+	for key, acc := range a.values {
+		var val string
+		switch a.kind {
+		case AggregateCount:
+			val = strconv.Itoa(acc.count)
+		case AggregateSum:
+			val = strconv.FormatFloat(acc.sum, 'f', -1, 64)
+		case AggregateDistinctCount:
+			val = strconv.Itoa(len(acc.distinct))
+		default:
+			val = acc.best
+		}
+		entries = append(entries, Entry{Key: key, Value: val})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
@@ -0,0 +1,73 @@
+package moredis
+
+import (
+	"testing"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type aggregatorTestSpec struct {
+	kind     string
+	vals     []string
+	expected string
+}
+
+var aggregatorTests = []aggregatorTestSpec{
+	{AggregateCount, []string{"a", "a", ""}, "3"},
+	{AggregateSum, []string{"1", "2.5", " 3 "}, "6.5"},
+	{AggregateMin, []string{"10", "9", "100"}, "9"},
+	{AggregateMax, []string{"10", "9", "100"}, "100"},
+	{AggregateMax, []string{"2016-01-02T00:00:00Z", "2016-03-01T00:00:00Z", "2015-12-31T00:00:00Z"}, "2016-03-01T00:00:00Z"},
+	{AggregateMin, []string{"b", "a", "c"}, "a"},
+	{AggregateDistinctCount, []string{"x", "y", "x"}, "2"},
+}
+
+func TestAggregator(t *testing.T) {
+	for _, spec := range aggregatorTests {
+		agg := newAggregator(spec.kind)
+		for _, val := range spec.vals {
+			assert.True(t, agg.add("k", val), spec.kind)
+		}
+		assert.Equal(t, []Entry{{Key: "k", Value: spec.expected}}, agg.entries(), "%s %v", spec.kind, spec.vals)
+	}
+
+	sum := newAggregator(AggregateSum)
+	assert.False(t, sum.add("k", "nope"))
+	assert.Empty(t, sum.entries())
+}
+
+func TestCheckAggregate(t *testing.T) {
+	assert.NoError(t, checkAggregate(""))
+	assert.NoError(t, checkAggregate(AggregateDistinctCount))
+	assert.EqualError(t, checkAggregate("avg"), `unknown aggregate "avg", must be one of count, sum, min, max, distinct_count`)
+}
+
+func TestProcessQueryAggregate(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"school": "s1", "active": true, "logins": 3},
+		{"school": "s2", "active": true, "logins": 1},
+		{"school": "s1", "active": true, "logins": "unknown"},
+		{"school": "s1", "active": false, "logins": 4},
+	})
+
+	collection := CollectionConfig{
+		Maps: []MapConfig{
+			{Key: "{{.school}}", Aggregate: AggregateCount, When: "{{.active}}", HashKey: "moredis:maps:1"},
+			{Key: "{{.school}}", Value: "{{.logins}}", Aggregate: AggregateSum, HashKey: "moredis:maps:2"},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "s1", "2").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:1", "s2", "1").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:2", "s1", "7").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:2", "s2", "1").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Maps[0].EntriesWritten)
+	assert.Equal(t, 2, report.Maps[1].EntriesWritten)
+	assert.Equal(t, map[string]int{"not_a_number": 1}, report.Maps[1].Skipped)
+}
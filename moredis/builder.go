@@ -0,0 +1,509 @@
+package moredis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/moredis/client"
+	"github.com/Clever/moredis/logger"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RedisPool is a source of redis connections, such as a *redis.Pool.  Connections are
+// closed when the Builder is done with them.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// SingleConnPool returns a RedisPool that always returns conn, which is left open.  It
+// can only be used by Builders with a concurrency of 1.
+func SingleConnPool(conn redis.Conn) RedisPool {
+	return singleConnPool{conn}
+}
+
+type singleConnPool struct {
+	conn redis.Conn
+}
+
+func (p singleConnPool) Get() redis.Conn {
+	return noCloseConn{p.conn}
+}
+
+// noCloseConn is a redis.Conn whose Close does nothing, so that the conn it wraps can be
+// used again.
+type noCloseConn struct {
+	redis.Conn
+}
+
+func (c noCloseConn) Close() error {
+	return nil
+}
+
+// Logger receives the log lines written while building caches.  The default Logger writes
+// them with the logger package.
+type Logger interface {
+	Info(title string, data logger.M)
+	Warning(title string, data logger.M)
+	Error(title string, err error)
+}
+
+type kayveeLogger struct{}
+
+func (kayveeLogger) Info(title string, data logger.M)    { logger.Info(title, data) }
+func (kayveeLogger) Warning(title string, data logger.M) { logger.Warning(title, data) }
+func (kayveeLogger) Error(title string, err error)       { logger.Error(title, err) }
+
+// Hooks are functions called at points during a build.  Any of them can be nil.
+type Hooks struct {
+	// BeforeCollection is called before each collection is queried.  Returning an error
+	// fails the build.
+	BeforeCollection func(ctx context.Context, collection CollectionConfig) error
+	// AfterSwap is called after each map is swapped to its new hash.  With a concurrency
+	// above 1, it can be called from several goroutines at once.
+	AfterSwap func(swap MapSwap)
+	// AfterBuild is called with the report of each build, whether or not it succeeded.
+	AfterBuild func(report BuildReport)
+}
+
+// buildOptions are the settings that BuilderOptions change.
+type buildOptions struct {
+	logger        Logger
+	metrics       MetricsSink
+	concurrency   int
+	flushInterval int
+	hooks         Hooks
+}
+
+func defaultBuildOptions() buildOptions {
+	return buildOptions{
+		logger:        kayveeLogger{},
+		metrics:       prometheusMetrics{},
+		concurrency:   1,
+		flushInterval: defaultFlushInterval,
+	}
+}
+
+// BuilderOption configures a Builder.
+type BuilderOption func(*buildOptions)
+
+// WithLogger sets the Logger that a Builder logs to.
+func WithLogger(l Logger) BuilderOption {
+	return func(o *buildOptions) {
+		o.logger = l
+	}
+}
+
+// WithMetrics sets the MetricsSink that a Builder records metrics in.
+func WithMetrics(m MetricsSink) BuilderOption {
+	return func(o *buildOptions) {
+		o.metrics = m
+	}
+}
+
+// WithConcurrency sets how many collections a Builder builds at once.  Each uses its own
+// redis connection and mongo session.  The default is 1.
+func WithConcurrency(n int) BuilderOption {
+	return func(o *buildOptions) {
+		if n > 0 {
+			o.concurrency = n
+		}
+	}
+}
+
+// WithFlushInterval sets how many redis commands are pipelined before they are flushed.
+// The default is 100.
+func WithFlushInterval(n int) BuilderOption {
+	return func(o *buildOptions) {
+		if n > 0 {
+			o.flushInterval = n
+		}
+	}
+}
+
+// WithHooks sets the Hooks that a Builder calls.
+func WithHooks(h Hooks) BuilderOption {
+	return func(o *buildOptions) {
+		o.hooks = h
+	}
+}
+
+// Builder builds caches using mongo and redis connections provided by the caller.  A Builder
+// can be used for any number of builds, including at the same time.
+type Builder struct {
+	redis RedisPool
+	opts  buildOptions
+	// find starts a query on a collection
+	find func(collection string, query, projection map[string]interface{}) MongoIter
+}
+
+// NewBuilder creates a Builder that reads from mongoDb and writes to connections from
+// redisPool.  The caller remains responsible for closing both.
+func NewBuilder(mongoDb *mgo.Database, redisPool RedisPool, options ...BuilderOption) *Builder {
+	b := &Builder{
+		redis: redisPool,
+		opts:  defaultBuildOptions(),
+		find: func(collection string, query, projection map[string]interface{}) MongoIter {
+			// copy the session so that concurrent collections don't share a socket
+			session := mongoDb.Session.Copy()
+			find := mongoDb.With(session).C(collection).Find(query)
+			if projection != nil {
+				find = find.Select(projection)
+			}
+			return sessionIter{find.Iter(), session}
+		},
+	}
+	for _, option := range options {
+		option(&b.opts)
+	}
+	return b
+}
+
+// sessionIter is a query iterator that closes its session when it is closed.
+type sessionIter struct {
+	*mgo.Iter
+	session *mgo.Session
+}
+
+func (i sessionIter) Close() error {
+	defer i.session.Close()
+	return i.Iter.Close()
+}
+
+// Build builds the cache described by cacheConfig, and returns a report describing the
+// build.  Collections are built in config order, except that collections whose lookups use
+// maps built by other collections are built after them.  The report is returned even if the build fails, covering the work done up to
+// the failure.  Cancelling ctx stops the build; maps that have already been swapped to
+// their new hashes stay swapped.
+func (b *Builder) Build(ctx context.Context, cacheConfig Config, params Params) (BuildReport, error) {
+	b.opts.logger.Info("Populating cache.", logger.M{"cache": cacheConfig.Name})
+	report := BuildReport{Cache: cacheConfig.Name, Start: time.Now()}
+	if b.opts.hooks.AfterBuild != nil {
+		defer func() { b.opts.hooks.AfterBuild(report) }()
+	}
+	buildID, err := newBuildID()
+	if err != nil {
+		report.finish(err)
+		return report, err
+	}
+	report.BuildID = buildID
+
+	// collections that look up maps built by other collections are built after them
+	order, deps, err := orderCollections(cacheConfig.Collections, params)
+	if err != nil {
+		report.finish(err)
+		return report, err
+	}
+
+	// the first collection to fail cancels the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reports := make([]CollectionReport, len(order))
+	errs := make([]error, len(order))
+	done := make([]chan struct{}, len(cacheConfig.Collections))
+	for cix := range done {
+		done[cix] = make(chan struct{})
+	}
+	sem := make(chan struct{}, b.opts.concurrency)
+	var wg sync.WaitGroup
+	started := 0
+	for ix, cix := range order {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(ix, cix int) {
+			defer wg.Done()
+			defer close(done[cix])
+			defer func() { <-sem }()
+			// dependencies come earlier in the order, so they already hold slots
+			for _, dep := range deps[cix] {
+				select {
+				case <-done[dep]:
+				case <-ctx.Done():
+				}
+			}
+			if errs[ix] = ctx.Err(); errs[ix] == nil {
+				reports[ix], errs[ix] = b.buildCollection(ctx, cacheConfig, params, buildID, cacheConfig.Collections[cix])
+			} else {
+				reports[ix] = newCollectionReport(cacheConfig.Collections[cix])
+			}
+			if errs[ix] != nil {
+				reports[ix].Error = errs[ix].Error()
+				cancel()
+			}
+		}(ix, cix)
+	}
+	wg.Wait()
+
+	report.Collections = reports[:started]
+	// report the error that failed the build, rather than the cancellations it caused
+	err = ctx.Err()
+	for _, collectionErr := range errs[:started] {
+		if collectionErr != nil && collectionErr != context.Canceled {
+			err = collectionErr
+			break
+		}
+	}
+	if err != nil {
+		report.finish(err)
+		return report, err
+	}
+	b.opts.logger.Info("Completed populating cache", logger.M{"cache": cacheConfig.Name})
+	report.finish(nil)
+	b.opts.metrics.BuildSucceeded(cacheConfig.Name, report.End.Sub(report.Start))
+	return report, nil
+}
+
+// buildCollection builds and swaps in the maps for a single collection.
+func (b *Builder) buildCollection(ctx context.Context, cacheConfig Config, params Params, buildID string,
+	collection CollectionConfig) (CollectionReport, error) {
+	// the build sets the hash keys and parsed templates of the maps and computed fields, so
+	// it works on copies rather than the caller's config, which other builds may be using
+	collection.Maps = append([]MapConfig(nil), collection.Maps...)
+	collection.Computed = append([]ComputedField(nil), collection.Computed...)
+	log := b.opts.logger
+	report := newCollectionReport(collection)
+	buildStart := time.Now()
+	if b.opts.hooks.BeforeCollection != nil {
+		if err := b.opts.hooks.BeforeCollection(ctx, collection); err != nil {
+			return report, err
+		}
+	}
+	var query map[string]interface{}
+	if collection.Derive == nil {
+		var err error
+		if query, err = parseTemplatedJSON(collection.Query, params, collection.Templates); err != nil {
+			log.Error("Failed to parse query", err)
+			return report, err
+		}
+	}
+
+	redisConn := b.redis.Get()
+	defer redisConn.Close()
+	redisWriter := &redisWriter{
+		conn:          redisConn,
+		flushInterval: b.opts.flushInterval,
+		cache:         cacheConfig.Name,
+		metrics:       b.opts.metrics,
+	}
+
+	if err := SetRedisHashKeys(redisConn, &collection); err != nil {
+		log.Error("Error setting up redis map keys", err)
+		return report, err
+	}
+
+	if err := ParseTemplates(&collection); err != nil {
+		log.Error("Error parsing templates", err)
+		return report, err
+	}
+	for ix, rmap := range collection.Maps {
+		// entities are keys of their own, which any redis can expire
+		if rmap.ExpiresTemplate != nil && len(rmap.Fields) == 0 && !hashFieldTTLSupported(redisConn) {
+			log.Warning("Redis can't expire hash fields, entries won't expire", logger.M{"map": rmap.Name})
+			collection.Maps[ix].ExpiresTemplate = nil
+		}
+	}
+
+	var iter MongoIter
+	if collection.Derive != nil {
+		derived, err := newDerivedIter(ctx, client.New(b.redis), *collection.Derive, params)
+		if err != nil {
+			log.Error("Error setting up derived map", err)
+			return report, err
+		}
+		for _, mapName := range derived.maps() {
+			if err := checkHashMap(redisConn, mapName); err != nil {
+				log.Error("Error setting up derived map", err)
+				return report, err
+			}
+		}
+		iter = derived
+		query = map[string]interface{}{"derive": derived.from}
+		log.Info("Deriving maps", logger.M{"from": derived.from})
+	} else {
+		iter = b.queryCollection(collection, query, params)
+	}
+	report, err := processQuery(ctx, b.opts, redisWriter, iter, cacheConfig.Name, collection, b.lookupFetcher(params, collection.Templates))
+	if err != nil {
+		log.Error("Error processing query", err)
+		return report, err
+	}
+	writeStart := time.Now()
+	if err := redisWriter.Flush(); err != nil {
+		log.Error("Error flushing redis conn", err)
+		return report, err
+	}
+	report.Timings.Write += time.Since(writeStart)
+	buildEnd := time.Now()
+
+	renderedQuery, err := json.Marshal(query)
+	if err != nil {
+		return report, err
+	}
+	for ix, rmap := range collection.Maps {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		mapReport := &report.Maps[ix]
+		if len(rmap.Fields) == 0 {
+			// entity maps have no hash to count, and writing an entity twice merges its fields
+			hashLen, err := redis.Int(redisConn.Do("HLEN", rmap.HashKey))
+			if err != nil {
+				mapReport.Error = err.Error()
+				return report, err
+			}
+			mapReport.Collisions = mapReport.EntriesWritten - hashLen
+		}
+
+		swapStart := time.Now()
+		rmap.Metadata = &MapMetadata{
+			HashKey:    rmap.HashKey,
+			BuildID:    buildID,
+			BuildStart: buildStart,
+			BuildEnd:   buildEnd,
+			Documents:  report.DocumentsScanned,
+			Entries:    mapReport.EntriesWritten,
+			Version:    Version,
+			Config:     cacheConfig.Name,
+			Params:     params,
+			Query:      string(renderedQuery),
+			Checksum:   mapReport.Checksum,
+		}
+		if len(rmap.Fields) > 0 {
+			rmap.Metadata.Kind = MapKindEntity
+		}
+		mapName, oldMap, err := updateRedisMapReference(redisConn, log, params, rmap)
+		if err != nil {
+			log.Error("Failed to update map reference", err)
+			mapReport.Error = err.Error()
+			return report, err
+		}
+		mapReport.Name = mapName
+		mapReport.OldHashKey = oldMap
+		swap := MapSwap{Map: mapName, OldHashKey: oldMap, NewHashKey: rmap.HashKey, BuildID: buildID}
+		if err := PublishMapSwap(redisConn, cacheConfig.Notify, swap); err != nil {
+			// the map has been swapped, so the build carries on with the next map
+			log.Error("Failed to publish map swap", err)
+			b.opts.metrics.NotifyFailed(cacheConfig.Name, mapName)
+			mapReport.NotifyError = err.Error()
+		}
+		report.Timings.Swap += time.Since(swapStart)
+		if b.opts.hooks.AfterSwap != nil {
+			b.opts.hooks.AfterSwap(swap)
+		}
+	}
+	return report, nil
+}
+
+// checkHashMap returns an error if mapName refers to an entity map.  orderCollections
+// rejects entity maps built by the same config, but maps built by other configs can only
+// be checked in redis.
+func (b *Builder) checkHashMap(mapName string) error {
+	conn := b.redis.Get()
+	defer conn.Close()
+	return checkHashMap(conn, mapName)
+}
+
+// lookupFetcher returns a lookupFetcher that fetches documents with the Builder's queries,
+// and map entries through the maps' references in redis.  Projections are rendered with
+// params and the named templates.
+func (b *Builder) lookupFetcher(params Params, templates map[string]string) lookupFetcher {
+	return func(ctx context.Context, lookup LookupConfig, keys []interface{}) (map[string]interface{}, error) {
+		found := map[string]interface{}{}
+		if lookup.Map != "" {
+			mapName, err := ApplyTemplate(lookup.Map, params.Bson())
+			if err != nil {
+				return nil, err
+			}
+			if err := b.checkHashMap(mapName); err != nil {
+				return nil, err
+			}
+			fields := make([]string, len(keys))
+			for ix, key := range keys {
+				fields[ix] = toString(key)
+			}
+			values, err := client.New(b.redis).LookupMany(ctx, mapName, fields)
+			if err == client.ErrNoMap {
+				return nil, fmt.Errorf("map %s does not exist", mapName)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for ix, key := range keys {
+				if val, ok := values[fields[ix]]; ok {
+					found[lookupCacheKey(key)] = val
+				}
+			}
+			return found, nil
+		}
+
+		var projection map[string]interface{}
+		if lookup.Projection != "" {
+			var err error
+			if projection, err = parseTemplatedJSON(lookup.Projection, params, templates); err != nil {
+				return nil, err
+			}
+		}
+		foreign := lookup.foreignField()
+		projectForeignField(projection, foreign)
+		query := map[string]interface{}{foreign: map[string]interface{}{"$in": keys}}
+		iter := b.find(lookup.Collection, query, projection)
+		var doc bson.M
+		for iter.Next(&doc) {
+			if key := pathValue(doc, strings.Split(foreign, ".")); key != nil {
+				if _, ok := found[lookupCacheKey(key)]; !ok {
+					found[lookupCacheKey(key)] = doc
+				}
+			}
+			doc = nil
+		}
+		if err := iter.Err(); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		return found, iter.Close()
+	}
+}
+
+// queryCollection starts the query for a collection, with its projection or one derived
+// from its templates.
+func (b *Builder) queryCollection(collection CollectionConfig, query map[string]interface{}, params Params) MongoIter {
+	log := b.opts.logger
+	var projection map[string]interface{}
+	if collection.Projection != "" {
+		var err error
+		projection, err = parseTemplatedJSON(collection.Projection, params, collection.Templates)
+		if err != nil {
+			log.Error("Error applying projection template", err)
+		}
+		if fields, all := templateFields(collection); !all {
+			if omitted := projectionOmits(projection, fields); len(omitted) > 0 {
+				log.Warning("Projection omits fields used by templates", logger.M{
+					"collection": collection.Collection,
+					"fields":     omitted,
+				})
+			}
+		}
+	} else if derived, ok := deriveProjection(collection); ok {
+		projection = derived
+	}
+	iter := b.find(collection.Collection, query, projection)
+
+	log.Info("Processing query for collection", logger.M{
+		"query":      query,
+		"collection": collection.Collection,
+		"projection": projection,
+	})
+	return iter
+}
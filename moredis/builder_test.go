@@ -0,0 +1,279 @@
+package moredis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Clever/moredis/logger"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recordingMetrics is a MetricsSink that counts the documents read, entries written,
+// builds and failed notifications.
+type recordingMetrics struct {
+	sync.Mutex
+	documents int
+	entries   map[string]int
+	builds    int
+	// notifyFailures counts the swap notifications that couldn't be sent
+	notifyFailures int
+}
+
+func (m *recordingMetrics) DocumentRead(cache, collection string) {
+	m.Lock()
+	defer m.Unlock()
+	m.documents++
+}
+
+func (m *recordingMetrics) EntryWritten(cache, mapName string) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[mapName]++
+}
+
+func (m *recordingMetrics) KeySkipped(cache, mapName, reason string)      {}
+func (m *recordingMetrics) TemplateError(cache, mapName, template string) {}
+func (m *recordingMetrics) NotifyFailed(cache, mapName string) {
+	m.Lock()
+	defer m.Unlock()
+	m.notifyFailures++
+}
+
+func (m *recordingMetrics) RedisFlushed(cache string, duration time.Duration) {}
+
+func (m *recordingMetrics) BuildSucceeded(cache string, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.builds++
+}
+
+// recordingLogger is a Logger that keeps the titles of the lines logged.
+type recordingLogger struct {
+	sync.Mutex
+	titles []string
+}
+
+func (l *recordingLogger) Info(title string, data logger.M)    { l.log(title) }
+func (l *recordingLogger) Warning(title string, data logger.M) { l.log(title) }
+func (l *recordingLogger) Error(title string, err error)       { l.log(title) }
+
+func (l *recordingLogger) log(title string) {
+	l.Lock()
+	defer l.Unlock()
+	l.titles = append(l.titles, title)
+}
+
+// newTestBuilder creates a Builder whose queries return the documents in collections.
+func newTestBuilder(collections map[string][]bson.M, options ...BuilderOption) *Builder {
+	b := NewBuilder(nil, SingleConnPool(redigomock.NewConn()), options...)
+	b.find = func(collection string, query, projection map[string]interface{}) MongoIter {
+		return NewMockIter(collections[collection])
+	}
+	return b
+}
+
+var builderTestConfig = Config{
+	Name: "test",
+	Collections: []CollectionConfig{
+		{
+			Collection: "users",
+			Query:      "{}",
+			Maps:       []MapConfig{{Name: "users", Key: "{{.id}}", Value: "{{.name}}"}},
+		},
+		{
+			Collection: "schools",
+			Query:      "{}",
+			Maps:       []MapConfig{{Name: "schools", Key: "{{.id}}", Value: "{{.name}}"}},
+		},
+	},
+}
+
+func TestBuilderBuild(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("INCR", "moredis:mapindexcounter").Expect(int64(1))
+	redigomock.GenericCommand("HSET").Expect(int64(1))
+	redigomock.GenericCommand("HMSET").Expect("OK")
+	redigomock.Command("HLEN", "moredis:maps:1").Expect(int64(1))
+	redigomock.Command("GETSET", "users", "moredis:maps:1").ExpectError(redis.ErrNil)
+	redigomock.Command("GETSET", "schools", "moredis:maps:1").Expect("moredis:maps:0")
+	redigomock.Command("DEL", "moredis:maps:0", "moredis:maps:0:meta").Expect(int64(1))
+
+	metrics := &recordingMetrics{entries: map[string]int{}}
+	log := &recordingLogger{}
+	var swaps []MapSwap
+	var reports []BuildReport
+	b := newTestBuilder(map[string][]bson.M{
+		"users":   {{"id": "1", "name": "alice"}},
+		"schools": {{"id": "2", "name": "hogwarts"}},
+	}, WithMetrics(metrics), WithLogger(log), WithHooks(Hooks{
+		AfterSwap:  func(swap MapSwap) { swaps = append(swaps, swap) },
+		AfterBuild: func(report BuildReport) { reports = append(reports, report) },
+	}))
+
+	report, err := b.Build(context.Background(), builderTestConfig, Params{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Error)
+	assert.Len(t, report.Collections, 2)
+	assert.Equal(t, "schools", report.Collections[1].Collection)
+	assert.Equal(t, "moredis:maps:0", report.Collections[1].Maps[0].OldHashKey)
+	assert.Equal(t, []BuildReport{report}, reports)
+
+	assert.Len(t, swaps, 2)
+	assert.Equal(t, "users", swaps[0].Map)
+	assert.Equal(t, report.BuildID, swaps[0].BuildID)
+	assert.Equal(t, 2, metrics.documents)
+	assert.Equal(t, map[string]int{"users": 1, "schools": 1}, metrics.entries)
+	assert.Equal(t, 1, metrics.builds)
+	assert.Contains(t, log.titles, "Completed populating cache")
+}
+
+func TestBuilderBuildConcurrent(t *testing.T) {
+	redigomock.Clear()
+	redigomock.GenericCommand("INCR").Expect(int64(1))
+	redigomock.GenericCommand("HSET").Expect(int64(1))
+	redigomock.GenericCommand("HMSET").Expect("OK")
+	redigomock.GenericCommand("HLEN").Expect(int64(1))
+	redigomock.GenericCommand("GETSET").ExpectError(redis.ErrNil)
+
+	// each build gets its own connections, and must not share the config's maps
+	b := NewBuilder(nil, mockPool{}, WithLogger(&recordingLogger{}))
+	b.find = func(collection string, query, projection map[string]interface{}) MongoIter {
+		return NewMockIter([]bson.M{{"id": "1", "name": collection}})
+	}
+	config := builderTestConfig
+	config.Collections = append([]CollectionConfig(nil), builderTestConfig.Collections...)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for ix := range errs {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			_, errs[ix] = b.Build(context.Background(), config, Params{})
+		}(ix)
+	}
+	wg.Wait()
+	assert.Equal(t, []error{nil, nil}, errs)
+	for _, collection := range config.Collections {
+		assert.Empty(t, collection.Maps[0].HashKey)
+		assert.Nil(t, collection.Maps[0].KeyTemplate)
+	}
+}
+
+func TestBuilderBuildNotifyFailure(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("INCR", "moredis:mapindexcounter").Expect(int64(1))
+	redigomock.GenericCommand("HSET").Expect(int64(1))
+	redigomock.GenericCommand("HMSET").Expect("OK")
+	redigomock.Command("HLEN", "moredis:maps:1").Expect(int64(1))
+	redigomock.GenericCommand("GETSET").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("PUBLISH").ExpectError(redis.Error("ERR boom"))
+
+	metrics := &recordingMetrics{entries: map[string]int{}}
+	var swaps []MapSwap
+	b := newTestBuilder(map[string][]bson.M{
+		"users":   {{"id": "1", "name": "alice"}},
+		"schools": {{"id": "2", "name": "hogwarts"}},
+	}, WithMetrics(metrics), WithLogger(&recordingLogger{}), WithHooks(Hooks{
+		AfterSwap: func(swap MapSwap) { swaps = append(swaps, swap) },
+	}))
+
+	// the maps were swapped, so failing to notify doesn't fail the build
+	config := builderTestConfig
+	config.Notify = NotifyConfig{Channel: "moredis:swaps"}
+	report, err := b.Build(context.Background(), config, Params{})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Error)
+	assert.Len(t, swaps, 2)
+	for _, collection := range report.Collections {
+		assert.Equal(t, "ERR boom", collection.Maps[0].NotifyError)
+		assert.Empty(t, collection.Maps[0].Error)
+	}
+	assert.Equal(t, 2, metrics.notifyFailures)
+	assert.Equal(t, 1, metrics.builds)
+}
+
+func TestBuilderBuildFailure(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("INCR", "moredis:mapindexcounter").Expect(int64(1))
+
+	hookErr := errors.New("not today")
+	metrics := &recordingMetrics{entries: map[string]int{}}
+	var queried []string
+	b := newTestBuilder(nil, WithMetrics(metrics), WithLogger(&recordingLogger{}), WithHooks(Hooks{
+		BeforeCollection: func(ctx context.Context, collection CollectionConfig) error {
+			queried = append(queried, collection.Collection)
+			return hookErr
+		},
+	}))
+
+	// the first collection's error stops the build
+	report, err := b.Build(context.Background(), builderTestConfig, Params{})
+	assert.Equal(t, hookErr, err)
+	assert.NotEmpty(t, report.Error)
+	assert.Equal(t, []string{"users"}, queried)
+	assert.Len(t, report.Collections, 1)
+	assert.Equal(t, "not today", report.Collections[0].Error)
+	assert.Equal(t, 0, metrics.builds)
+}
+
+func TestBuilderBuildCancelled(t *testing.T) {
+	redigomock.Clear()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b := newTestBuilder(nil, WithLogger(&recordingLogger{}))
+	report, err := b.Build(ctx, builderTestConfig, Params{})
+	assert.Equal(t, context.Canceled, err)
+	assert.NotEmpty(t, report.Error)
+	assert.Empty(t, report.Collections)
+
+	// cancelling stops a query part way through
+	ctx, cancel = context.WithCancel(context.Background())
+	writer := NewRedisWriter(redigomock.NewConn())
+	collection := CollectionConfig{Maps: []MapConfig{{HashKey: "moredis:maps:1", Key: "{{.id}}", Value: "{{.id}}"}}}
+	assert.NoError(t, ParseTemplates(&collection))
+	redigomock.GenericCommand("HSET").Expect(int64(1))
+	iter := &cancellingIter{MockIter: NewMockIter([]bson.M{{"id": "1"}, {"id": "2"}, {"id": "3"}}), cancel: cancel}
+	collectionReport, err := processQuery(ctx, defaultBuildOptions(), writer, iter, "", collection, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, collectionReport.DocumentsScanned)
+	assert.True(t, iter.closed)
+}
+
+// cancellingIter cancels its context after returning the first document.
+type cancellingIter struct {
+	*MockIter
+	cancel func()
+	closed bool
+}
+
+func (i *cancellingIter) Next(result interface{}) bool {
+	if i.current == 1 {
+		i.cancel()
+	}
+	return i.MockIter.Next(result)
+}
+
+func (i *cancellingIter) Close() error {
+	i.closed = true
+	return nil
+}
+
+func TestBuilderOptions(t *testing.T) {
+	b := NewBuilder(nil, SingleConnPool(redigomock.NewConn()), WithConcurrency(4), WithFlushInterval(10))
+	assert.Equal(t, 4, b.opts.concurrency)
+	assert.Equal(t, 10, b.opts.flushInterval)
+	assert.Equal(t, kayveeLogger{}, b.opts.logger)
+
+	// invalid values leave the defaults in place
+	b = NewBuilder(nil, SingleConnPool(redigomock.NewConn()), WithConcurrency(0), WithFlushInterval(-1))
+	assert.Equal(t, 1, b.opts.concurrency)
+	assert.Equal(t, defaultFlushInterval, b.opts.flushInterval)
+}
@@ -1,16 +1,21 @@
 package moredis
 
 import (
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Config is the config for the cache
 type Config struct {
 	Name        string             `yaml:"name"`
 	Collections []CollectionConfig `yaml:"collections"`
+	Notify      NotifyConfig       `yaml:"notify"`
 }
 
 // CollectionConfig is the config for a specific collection
@@ -19,29 +24,310 @@ type CollectionConfig struct {
 	Query      string      `yaml:"query"`
 	Projection string      `yaml:"projection"`
 	Maps       []MapConfig `yaml:"maps"`
+	// Derive, if set, makes the collection read the entries of a map in place of
+	// querying Collection.
+	Derive *DeriveConfig `yaml:"derive"`
+	// Lookups join documents from other collections, or entries from maps, onto each
+	// document.  They are fetched in batches, before computed fields are evaluated.
+	Lookups []LookupConfig `yaml:"lookups"`
+	// Computed are fields computed from each document before its entries are written, in
+	// order, so that later fields can use earlier ones.  The maps' templates, including
+	// their when templates, can use computed fields like any other field.
+	Computed []ComputedField `yaml:"computed"`
+
+	// Templates are the named templates from the config files, which the collection's
+	// templates can invoke.
+	Templates map[string]string `yaml:"-"`
+}
+
+// ComputedField is a field set on each document to the value of an expression.  See
+// Expression for the expression language.
+type ComputedField struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+
+	Expression *Expression `yaml:"-"`
 }
 
 // MapConfig is the config for a specific map.
 type MapConfig struct {
-	Name          string `yaml:"name"`
-	Key           string `yaml:"key"`
-	Value         string `yaml:"val"`
-	HashKey       string
-	KeyTemplate   *template.Template
-	ValueTemplate *template.Template
+	Name  string `yaml:"name"`
+	Key   string `yaml:"key"`
+	Value string `yaml:"val"`
+	// ForEach is an optional dotted path to an array in each document.  If it is set,
+	// the key and val templates are evaluated once per element of the array, with the
+	// element available as .item.
+	ForEach string `yaml:"for_each"`
+	// ValueJSON, if set, makes the values of the map JSON objects built from each
+	// document, in place of the val template.
+	ValueJSON *JSONValueConfig `yaml:"val_json"`
+	// Missing sets how fields missing from a document are handled in the key and val
+	// templates.  It is one of the Missing* constants, or empty to write missing
+	// fields as "<no value>" (skipping keys that are entirely "<no value>").
+	Missing string `yaml:"missing"`
+	// MissingDefault is the value written in place of missing fields in "default" mode.
+	MissingDefault string `yaml:"missing_default"`
+	// When is an optional template evaluated against each document.  Documents for which
+	// it renders as a falsy value ("", "false", "0" or "<no value>") are skipped for the map.
+	When string `yaml:"when"`
+	// Transform names a Transform registered with RegisterTransform, which computes the
+	// entries for each document in place of the key and val templates.
+	Transform string `yaml:"transform"`
+	// Script is a Lua script that computes the entries for each document in place of the
+	// key and val templates.  ScriptTimeout limits how long it can run for each document,
+	// e.g. "50ms", and defaults to 100ms.
+	Script        string `yaml:"script"`
+	ScriptTimeout string `yaml:"script_timeout"`
+	// Fields, if set, makes the map an entity map: each entry is a redis hash of its own,
+	// named by the key template, with fields named by the keys of Fields and set from
+	// their templates.  See EntityKey.
+	Fields map[string]string `yaml:"fields"`
+	// Aggregate makes the map hold one value per key, aggregated from the values of all
+	// of the entries for that key.  It is one of the Aggregate* constants.  The val
+	// template gives the value aggregated, and can be left out for count.
+	Aggregate string `yaml:"aggregate"`
+	// TTL, e.g. "24h", makes the map expire if it isn't rebuilt within that long.  It is
+	// set on the map's name and hash after each swap, and on each entity of entity maps as
+	// it is written.
+	TTL string `yaml:"ttl"`
+	// Expires is an optional template giving when each entry expires, as an RFC3339 date
+	// or a duration.  Entries for which it renders as empty don't expire.  Expiring the
+	// entries of maps other than entity maps needs redis 7.4, and is left out otherwise.
+	Expires string `yaml:"expires"`
+
+	HashKey       string             `yaml:"-"`
+	KeyTemplate   *template.Template `yaml:"-"`
+	ValueTemplate *template.Template `yaml:"-"`
+	WhenTemplate  *template.Template `yaml:"-"`
+	TransformFunc Transform          `yaml:"-"`
+	// ExpiresTemplate is the parsed Expires template, and TTLDuration the parsed TTL.
+	ExpiresTemplate *template.Template `yaml:"-"`
+	TTLDuration     time.Duration      `yaml:"-"`
+	// FieldNames are the names of an entity map's fields in order, and FieldTemplates
+	// their parsed templates.
+	FieldNames     []string             `yaml:"-"`
+	FieldTemplates []*template.Template `yaml:"-"`
+	Metadata       *MapMetadata         `yaml:"-"`
+	// missingFields tracks the missing fields used by the map's templates
+	missingFields *missingTracker
+}
+
+// Ways of handling fields that are missing from a document, for MapConfig.Missing.
+const (
+	// MissingError fails the build.
+	MissingError = "error"
+	// MissingSkip skips the document for the map.
+	MissingSkip = "skip"
+	// MissingEmpty writes missing fields as the empty string.
+	MissingEmpty = "empty"
+	// MissingDefault writes missing fields as MapConfig.MissingDefault.
+	MissingDefault = "default"
+)
+
+// ConfigFile is the contents of a config file.  A file can describe a single cache at the
+// top level, or several caches under caches, and can include other config files.
+type ConfigFile struct {
+	Config `yaml:",inline"`
+	Caches []Config `yaml:"caches"`
+	// Include lists other config files to load, as paths or glob patterns relative to the
+	// directory of this file.
+	Include []string `yaml:"include"`
+	// Templates are named templates that can be invoked by the templates of every cache
+	// loaded along with this file, with {{template "name" .}}
+	Templates map[string]string `yaml:"templates"`
+}
+
+// caches returns the caches described by the file.
+func (f ConfigFile) caches() []Config {
+	caches := []Config{}
+	if f.Name != "" || len(f.Collections) > 0 {
+		caches = append(caches, f.Config)
+	}
+	return append(caches, f.Caches...)
 }
 
 // LoadConfig takes a path to a config yaml file and loads it into the appropriate structs.
+// The file, along with any files it includes, must describe exactly one cache.
 func LoadConfig(path string) (Config, error) {
-	raw, err := ioutil.ReadFile(path)
+	caches, err := LoadConfigs(path)
 	if err != nil {
 		return Config{}, err
 	}
+	if len(caches) != 1 {
+		return Config{}, fmt.Errorf("%s describes %d caches, expected 1", path, len(caches))
+	}
+	return caches[0], nil
+}
 
-	var conf Config
-	if err := yaml.Unmarshal(raw, &conf); err != nil {
-		return Config{}, err
+// LoadConfigs loads the caches described by a config file and the files it includes.
+func LoadConfigs(path string) ([]Config, error) {
+	caches := []Config{}
+	names := map[string]string{}
+	templates := map[string]string{}
+	err := readConfigFiles(path, map[string]bool{}, func(path string, raw []byte) (ConfigFile, error) {
+		file, err := decodeConfigFile(path, raw)
+		if err != nil {
+			return file, err
+		}
+		for name, text := range file.Templates {
+			if existing, ok := templates[name]; ok && existing != text {
+				return file, fmt.Errorf("%s: template %q is already defined differently", path, name)
+			}
+			templates[name] = text
+		}
+		for _, cache := range file.caches() {
+			if first, ok := names[cache.Name]; ok {
+				return file, fmt.Errorf("%s: cache %q is already defined in %s", path, cache.Name, first)
+			}
+			names[cache.Name] = path
+			caches = append(caches, cache)
+		}
+		return file, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return conf, nil
+	for cix := range caches {
+		for ix := range caches[cix].Collections {
+			caches[cix].Collections[ix].Templates = templates
+		}
+	}
+	return caches, nil
+}
+
+// decodeConfigFile decodes a config file, interpolating environment variables and secret
+// files into its values.
+func decodeConfigFile(path string, raw []byte) (ConfigFile, error) {
+	var file ConfigFile
+	var root yaml.Node
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		return file, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(root.Content) == 0 {
+		return file, nil
+	}
+	var interpolateErr error
+	interpolateNode(&root, func(node *yaml.Node, err error) {
+		if interpolateErr == nil {
+			interpolateErr = fmt.Errorf("%s:%d: %s", path, node.Line, err)
+		}
+	})
+	if interpolateErr != nil {
+		return file, interpolateErr
+	}
+	if err := root.Decode(&file); err != nil {
+		return file, fmt.Errorf("%s: %s", path, err)
+	}
+	return file, nil
+}
+
+// readConfigFiles reads the config file at path and passes it to load, then does the same
+// for the files it includes.  seen holds the absolute paths of the files already read, and
+// each file is only read once, so files can be included from several places.
+func readConfigFiles(path string, seen map[string]bool, load func(path string, raw []byte) (ConfigFile, error)) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if seen[abs] {
+		return nil
+	}
+	seen[abs] = true
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := load(path, raw)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range file.Include {
+		includes, err := expandInclude(path, pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		for _, include := range includes {
+			if err := readConfigFiles(include, seen, load); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandInclude returns the files matched by an include pattern in the config file at path.
+// It is an error for a pattern that isn't a glob to match nothing.
+func expandInclude(path, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include %q: %s", pattern, err)
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("included file %s does not exist", pattern)
+	}
+	return matches, nil
+}
+
+// FilterConfigs returns the caches named in caches, keeping only the maps whose names (with
+// params applied) are in maps.  An empty list of names keeps everything.  Collections and
+// caches left without maps are dropped.  It is an error for a name to match nothing.
+func FilterConfigs(configs []Config, params Params, caches, maps []string) ([]Config, error) {
+	wantCache := stringSet(caches)
+	wantMap := stringSet(maps)
+	foundCache, foundMap := map[string]bool{}, map[string]bool{}
+	filtered := []Config{}
+	for _, conf := range configs {
+		if len(wantCache) > 0 && !wantCache[conf.Name] {
+			continue
+		}
+		foundCache[conf.Name] = true
+		collections := []CollectionConfig{}
+		for _, collection := range conf.Collections {
+			collectionMaps := []MapConfig{}
+			for _, rmap := range collection.Maps {
+				mapName, err := ApplyTemplate(rmap.Name, params.Bson())
+				if err != nil {
+					return nil, err
+				}
+				if len(wantMap) > 0 && !wantMap[mapName] {
+					continue
+				}
+				foundMap[mapName] = true
+				collectionMaps = append(collectionMaps, rmap)
+			}
+			if len(collectionMaps) > 0 {
+				collection.Maps = collectionMaps
+				collections = append(collections, collection)
+			}
+		}
+		if len(collections) > 0 {
+			conf.Collections = collections
+			filtered = append(filtered, conf)
+		}
+	}
+
+	for _, name := range caches {
+		if !foundCache[name] {
+			return nil, fmt.Errorf("no cache named %q", name)
+		}
+	}
+	for _, name := range maps {
+		if !foundMap[name] {
+			return nil, fmt.Errorf("no map named %q", name)
+		}
+	}
+	return filtered, nil
+}
+
+func stringSet(strs []string) map[string]bool {
+	set := make(map[string]bool, len(strs))
+	for _, str := range strs {
+		set[str] = true
+	}
+	return set
 }
@@ -0,0 +1,142 @@
+package moredis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes files (by path relative to a temporary directory) and returns
+// the directory.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "moredis")
+	assert.NoError(t, err)
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+	return dir
+}
+
+var multiCacheFiles = map[string]string{
+	"config.yml": `include: ['common.yml', 'caches/*.yml']
+caches:
+  - name: 'users'
+    collections:
+      - collection: 'users'
+        query: '{{template "active" .}}'
+        maps:
+          - name: 'users:email'
+            key: '{{.email}}'
+            val: '{{._id}}'
+          - name: 'users:phone'
+            key: '{{.phone}}'
+            val: '{{._id}}'
+`,
+	"common.yml": `templates:
+  active: '{"active": true}'
+`,
+	"caches/accounts.yml": `name: 'accounts'
+include: ['../common.yml']
+collections:
+  - collection: 'accounts'
+    query: '{{template "active" .}}'
+    maps:
+      - name: 'accounts:{{.env}}'
+        key: '{{.name}}'
+        val: '{{._id}}'
+`,
+	"caches/groups.yml": `caches:
+  - name: 'groups'
+    collections:
+      - collection: 'groups'
+        query: &all '{}'
+        maps:
+          - name: 'groups:name'
+            key: '{{.name}}'
+            val: '{{._id}}'
+  - name: 'sections'
+    collections:
+      - collection: 'sections'
+        query: *all
+        maps:
+          - name: 'sections:name'
+            key: '{{.name}}'
+            val: '{{._id}}'
+`,
+}
+
+func TestLoadConfigs(t *testing.T) {
+	dir := writeConfigFiles(t, multiCacheFiles)
+	defer os.RemoveAll(dir)
+
+	caches, err := LoadConfigs(filepath.Join(dir, "config.yml"))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, cache := range caches {
+		names = append(names, cache.Name)
+	}
+	assert.Equal(t, []string{"users", "accounts", "groups", "sections"}, names)
+	assert.Equal(t, "{}", caches[3].Collections[0].Query)
+	templates := map[string]string{"active": `{"active": true}`}
+	assert.Equal(t, templates, caches[0].Collections[0].Templates)
+	assert.Equal(t, templates, caches[1].Collections[0].Templates)
+
+	query, err := parseTemplatedJSON(caches[0].Collections[0].Query, Params{}, caches[0].Collections[0].Templates)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"active": true}, query)
+
+	_, err = LoadConfig(filepath.Join(dir, "config.yml"))
+	assert.EqualError(t, err, filepath.Join(dir, "config.yml")+" describes 4 caches, expected 1")
+	cache, err := LoadConfig(filepath.Join(dir, "caches", "accounts.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "accounts", cache.Name)
+}
+
+func TestLoadConfigsErrors(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"missing.yml":   "include: ['nope.yml']\n",
+		"duplicate.yml": "include: ['missing.yml']\nname: 'a'\ncollections: []\ncaches: [{name: 'a'}]\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := LoadConfigs(filepath.Join(dir, "missing.yml"))
+	assert.EqualError(t, err, filepath.Join(dir, "missing.yml")+": included file "+filepath.Join(dir, "nope.yml")+" does not exist")
+	_, err = LoadConfigs(filepath.Join(dir, "duplicate.yml"))
+	assert.EqualError(t, err, filepath.Join(dir, "duplicate.yml")+`: cache "a" is already defined in `+filepath.Join(dir, "duplicate.yml"))
+}
+
+func TestFilterConfigs(t *testing.T) {
+	dir := writeConfigFiles(t, multiCacheFiles)
+	defer os.RemoveAll(dir)
+	caches, err := LoadConfigs(filepath.Join(dir, "config.yml"))
+	assert.NoError(t, err)
+	params := Params{"env": "prod"}
+
+	filtered, err := FilterConfigs(caches, params, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, caches, filtered)
+
+	filtered, err = FilterConfigs(caches, params, []string{"groups", "accounts"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, filtered, 2)
+	assert.Equal(t, "accounts", filtered[0].Name)
+	assert.Equal(t, "groups", filtered[1].Name)
+
+	filtered, err = FilterConfigs(caches, params, nil, []string{"users:phone", "accounts:prod"})
+	assert.NoError(t, err)
+	assert.Len(t, filtered, 2)
+	assert.Len(t, filtered[0].Collections[0].Maps, 1)
+	assert.Equal(t, "users:phone", filtered[0].Collections[0].Maps[0].Name)
+	assert.Equal(t, "accounts", filtered[1].Name)
+	assert.Len(t, caches[0].Collections[0].Maps, 2, "the original configs are unchanged")
+
+	_, err = FilterConfigs(caches, params, []string{"users"}, []string{"groups:name"})
+	assert.EqualError(t, err, `no map named "groups:name"`)
+	_, err = FilterConfigs(caches, params, []string{"nope"}, nil)
+	assert.EqualError(t, err, `no cache named "nope"`)
+}
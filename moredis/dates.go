@@ -0,0 +1,207 @@
+package moredis
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The functions in this file are exported to templates for working with dates.  Functions
+// that take a date accept BSON dates and RFC3339 strings, and treat anything else as a
+// missing date: formatting functions return the empty string and arithmetic functions
+// return nil.
+
+// queryDate is a date produced by a function in a query or projection template.  It
+// renders as a MongoDB extended JSON date, which ParseTemplatedJSON turns back into a
+// BSON date, so that {"updated": {"$gte": {{daysAgo 7}}}} compares dates rather than strings.
+type queryDate time.Time
+
+// String renders the date as {"$date": "<RFC3339>"}.
+func (d queryDate) String() string {
+	return `{"$date":"` + time.Time(d).UTC().Format(time.RFC3339Nano) + `"}`
+}
+
+// asTime converts dates to time.Time.  The second return value is false for non-dates.
+func asTime(toConvert interface{}) (time.Time, bool) {
+	switch toConvert := toConvert.(type) {
+	case time.Time:
+		return toConvert, true
+	case queryDate:
+		return time.Time(toConvert), true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, toConvert)
+		return t, err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// mapTime applies fn to a date, keeping dates from query templates as query dates so they
+// still render as BSON dates.  For non-dates, this will return nil.
+func mapTime(toConvert interface{}, fn func(time.Time) time.Time) interface{} {
+	t, ok := asTime(toConvert)
+	if !ok {
+		return nil
+	}
+	if _, ok := toConvert.(queryDate); ok {
+		return queryDate(fn(t))
+	}
+	return fn(t)
+}
+
+// formatRFC3339 is exported to templates as 'rfc3339', and formats a date as an RFC3339
+// string in UTC.
+func formatRFC3339(toConvert interface{}) string {
+	t, ok := asTime(toConvert)
+	if !ok {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// unixSeconds is exported to templates as 'unix', and returns a date as seconds since the
+// unix epoch.
+func unixSeconds(toConvert interface{}) interface{} {
+	t, ok := asTime(toConvert)
+	if !ok {
+		return ""
+	}
+	return t.Unix()
+}
+
+// unixMillis is exported to templates as 'unixMillis', and returns a date as milliseconds
+// since the unix epoch.
+func unixMillis(toConvert interface{}) interface{} {
+	t, ok := asTime(toConvert)
+	if !ok {
+		return ""
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// formatDate is exported to templates as 'formatDate', and formats a date using a go
+// layout string, e.g. {{formatDate "2006-01-02" .created}}
+func formatDate(layout string, toConvert interface{}) string {
+	t, ok := asTime(toConvert)
+	if !ok {
+		return ""
+	}
+	return t.Format(layout)
+}
+
+// parseDate is exported to templates as 'parseDate', and parses a string into a date using
+// a go layout string.  Strings that don't match the layout give nil.
+func parseDate(layout string, toConvert interface{}) interface{} {
+	str, ok := toConvert.(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(layout, str)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+var (
+	locationCache   = map[string]*time.Location{}
+	locationCacheMu sync.Mutex
+)
+
+// loadLocation loads a timezone by name, caching the result since templates are executed
+// once per document.
+func loadLocation(name string) (*time.Location, error) {
+	locationCacheMu.Lock()
+	defer locationCacheMu.Unlock()
+	if loc, ok := locationCache[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationCache[name] = loc
+	return loc, nil
+}
+
+// inTimezone is exported to templates as 'inTimezone', and converts a date to the named
+// timezone, e.g. {{.created | inTimezone "America/New_York" | formatDate "2006-01-02"}}
+// An unknown timezone is a template error.
+func inTimezone(name string, toConvert interface{}) (interface{}, error) {
+	loc, err := loadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	return mapTime(toConvert, func(t time.Time) time.Time { return t.In(loc) }), nil
+}
+
+// addDuration is exported to templates as 'addDuration', and adds a duration such as
+// "36h" or "-15m" to a date.  An invalid duration is a template error.
+func addDuration(duration string, toConvert interface{}) (interface{}, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+	return mapTime(toConvert, func(t time.Time) time.Time { return t.Add(d) }), nil
+}
+
+// addDays is exported to templates as 'addDays', and adds a number of days to a date.
+func addDays(days int, toConvert interface{}) interface{} {
+	return mapTime(toConvert, func(t time.Time) time.Time { return t.AddDate(0, 0, days) })
+}
+
+// now, daysAgo and hoursAgo are exported to key and val templates.  Query and projection
+// templates get versions of them that produce BSON dates.
+func now() time.Time {
+	return time.Now()
+}
+
+func daysAgo(days int) time.Time {
+	return time.Now().AddDate(0, 0, -days)
+}
+
+func hoursAgo(hours int) time.Time {
+	return time.Now().Add(-time.Duration(hours) * time.Hour)
+}
+
+// queryFuncs are the functions that are exported to query and projection templates in
+// place of the functions of the same name in funcMap.
+var queryFuncs = map[string]interface{}{
+	"now": func() queryDate {
+		return queryDate(now())
+	},
+	"daysAgo": func(days int) queryDate {
+		return queryDate(daysAgo(days))
+	},
+	"hoursAgo": func(hours int) queryDate {
+		return queryDate(hoursAgo(hours))
+	},
+	// date turns a date from params or parseDate into a BSON date, e.g.
+	// {"created": {"$gte": {{parseDate "2006-01-02" .since | date}}}}
+	"date": func(toConvert interface{}) (queryDate, error) {
+		t, ok := asTime(toConvert)
+		if !ok {
+			return queryDate{}, errNotADate
+		}
+		return queryDate(t), nil
+	},
+}
+
+var errNotADate = errors.New("value is not a date")
+
+// extendedJSONDate converts a MongoDB extended JSON date ({"$date": "<RFC3339>"} or
+// {"$date": <millis>}) to a time.Time.  The second return value is false for anything else.
+func extendedJSONDate(val map[string]interface{}) (time.Time, bool) {
+	if len(val) != 1 {
+		return time.Time{}, false
+	}
+	switch date := val["$date"].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, date)
+		return t, err == nil
+	case float64:
+		return time.Unix(0, int64(date)*int64(time.Millisecond)).UTC(), true
+	default:
+		return time.Time{}, false
+	}
+}
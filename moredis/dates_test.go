@@ -0,0 +1,120 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testDate = time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC)
+
+var dateFuncTests = []applyTemplateTestSpec{
+	{
+		name:           "rfc3339",
+		templateString: "{{rfc3339 .date}}",
+		payload:        bson.M{"date": testDate},
+		expected:       "2016-03-04T05:06:07Z",
+	},
+	{
+		name:           "rfc3339 non-date",
+		templateString: "{{rfc3339 .date}}",
+		payload:        bson.M{"date": 5},
+		expected:       "",
+	},
+	{
+		name:           "unix",
+		templateString: "{{unix .date}}",
+		payload:        bson.M{"date": testDate},
+		expected:       "1457067967",
+	},
+	{
+		name:           "unixMillis",
+		templateString: "{{unixMillis .date}}",
+		payload:        bson.M{"date": testDate.Add(5 * time.Millisecond)},
+		expected:       "1457067967005",
+	},
+	{
+		name:           "formatDate",
+		templateString: `{{formatDate "2006-01-02" .date}}`,
+		payload:        bson.M{"date": testDate},
+		expected:       "2016-03-04",
+	},
+	{
+		name:           "formatDate from RFC3339 string",
+		templateString: `{{formatDate "Jan 2, 2006" .date}}`,
+		payload:        bson.M{"date": "2016-03-04T05:06:07Z"},
+		expected:       "Mar 4, 2016",
+	},
+	{
+		name:           "inTimezone",
+		templateString: `{{.date | inTimezone "America/New_York" | formatDate "2006-01-02 15:04"}}`,
+		payload:        bson.M{"date": testDate},
+		expected:       "2016-03-04 00:06",
+	},
+	{
+		name:           "inTimezone unknown timezone",
+		templateString: `{{.date | inTimezone "Nowhere/Special"}}`,
+		payload:        bson.M{"date": testDate},
+		expectedError:  true,
+	},
+	{
+		name:           "addDays",
+		templateString: `{{.date | addDays -7 | rfc3339}}`,
+		payload:        bson.M{"date": testDate},
+		expected:       "2016-02-26T05:06:07Z",
+	},
+	{
+		name:           "addDuration",
+		templateString: `{{.date | addDuration "90m" | rfc3339}}`,
+		payload:        bson.M{"date": testDate},
+		expected:       "2016-03-04T06:36:07Z",
+	},
+	{
+		name:           "addDays missing",
+		templateString: `{{.missing | addDays 1 | rfc3339}}`,
+		payload:        bson.M{},
+		expected:       "",
+	},
+	{
+		name:           "parseDate",
+		templateString: `{{.date | parseDate "01/02/2006" | rfc3339}}`,
+		payload:        bson.M{"date": "03/04/2016"},
+		expected:       "2016-03-04T00:00:00Z",
+	},
+}
+
+func TestDateFuncs(t *testing.T) {
+	for _, testCase := range dateFuncTests {
+		actual, err := ApplyTemplate(testCase.templateString, testCase.payload)
+		if !testCase.expectedError {
+			assert.Nil(t, err, "failed date func test: %s", testCase.name)
+			assert.Equal(t, testCase.expected, actual, "failed date func test: %s", testCase.name)
+		} else {
+			assert.Error(t, err, "wanted error, but returned %s", actual)
+		}
+	}
+}
+
+func TestParseTemplatedJSONDates(t *testing.T) {
+	actual, err := ParseTemplatedJSON(`{"updated": {"$gte": {{daysAgo 7}}}}`, Params{})
+	assert.Nil(t, err)
+	gte, ok := actual["updated"].(map[string]interface{})["$gte"].(time.Time)
+	assert.True(t, ok, "expected a date, got %v", actual["updated"])
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, -7), gte, time.Minute)
+
+	actual, err = ParseTemplatedJSON(`{"created": {"$lt": {{parseDate "2006-01-02" .before | date}}}}`,
+		Params{"before": "2016-03-04"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"created": map[string]interface{}{"$lt": time.Date(2016, 3, 4, 0, 0, 0, 0, time.UTC)},
+	}, actual)
+
+	actual, err = ParseTemplatedJSON(`{"created": {"$date": 1457067967000}}`, Params{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"created": testDate}, actual)
+
+	_, err = ParseTemplatedJSON(`{"created": {{date .before}}}`, Params{"before": "not a date"})
+	assert.Error(t, err)
+}
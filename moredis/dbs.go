@@ -24,19 +24,29 @@ func SetupDbs(mongoURL, redisURL string) (*mgo.Database, redis.Conn, error) {
 
 	// empty db string uses the db from the connection url
 	mongoDB := mongoSession.DB("")
-	logger.Info("Connected to mongo", logger.M{"mongo_url": mongoURL})
+	logger.Info("Connected to mongo", logger.M{"mongo_url": redactURL(mongoURL)})
 
-	redisURL, err = resolveRedis(redisURL)
+	redisConn, err := DialRedis(redisURL)
 	if err != nil {
 		return nil, nil, err
 	}
+	return mongoDB, redisConn, nil
+}
+
+// DialRedis connects to redis, resolving the master first if redisURL is a sentinel address.
+// The caller is responsible for closing the returned connection.
+func DialRedis(redisURL string) (redis.Conn, error) {
+	redisURL, err := resolveRedis(redisURL)
+	if err != nil {
+		return nil, err
+	}
 
 	redisConn, err := redis.DialTimeout("tcp", redisURL, 15*time.Second, 10*time.Second, 10*time.Second)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	logger.Info("Connected to redis", logger.M{"redis_url": redisURL})
-	return mongoDB, redisConn, nil
+	logger.Info("Connected to redis", logger.M{"redis_url": redactURL(redisURL)})
+	return redisConn, nil
 }
 
 // resolveRedis takes in a redis address and checks for a sentinel:// prefix to resolve. If one is present, it uses
@@ -82,10 +92,16 @@ type RedisWriter interface {
 	Flush() error
 }
 
+// defaultFlushInterval is the number of commands a RedisWriter buffers before flushing.
+const defaultFlushInterval = 100
+
 type redisWriter struct {
 	conn          redis.Conn
 	flushInterval int
 	currentCount  int
+	// cache is used to label flush latency metrics.
+	cache   string
+	metrics MetricsSink
 }
 
 // NewRedisWriter creates a new RedisWriter.  We wrap redis.Conn here so that we can specify how many
@@ -93,7 +109,7 @@ type redisWriter struct {
 func NewRedisWriter(conn redis.Conn) RedisWriter {
 	writer := &redisWriter{
 		conn:          conn,
-		flushInterval: 100,
+		flushInterval: defaultFlushInterval,
 	}
 	return writer
 }
@@ -106,7 +122,8 @@ func (r *redisWriter) Send(cmd string, args ...interface{}) error {
 	}
 	r.currentCount++
 	if r.currentCount >= r.flushInterval {
-		if err := r.Flush(); err != nil {
+		start := time.Now()
+		if err := r.conn.Flush(); err != nil {
 			return err
 		}
 		r.currentCount = 0
@@ -114,6 +131,7 @@ func (r *redisWriter) Send(cmd string, args ...interface{}) error {
 		if _, err := r.conn.Do("PING"); err != nil {
 			return err
 		}
+		r.flushed(time.Since(start))
 	}
 	return nil
 
@@ -121,5 +139,17 @@ func (r *redisWriter) Send(cmd string, args ...interface{}) error {
 
 // Flush triggers a flush on the underlying redis connection.
 func (r *redisWriter) Flush() error {
-	return r.conn.Flush()
+	start := time.Now()
+	if err := r.conn.Flush(); err != nil {
+		return err
+	}
+	r.flushed(time.Since(start))
+	return nil
+}
+
+func (r *redisWriter) flushed(duration time.Duration) {
+	if r.metrics == nil {
+		r.metrics = prometheusMetrics{}
+	}
+	r.metrics.RedisFlushed(r.cache, duration)
 }
@@ -0,0 +1,187 @@
+package moredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Clever/moredis/client"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeriveConfig makes a collection read the entries of an existing map in place of querying
+// mongo.  Each entry becomes a document with the fields key and val, after the steps have
+// been applied to it in order.
+type DeriveConfig struct {
+	// From is the name of the map to read.  It is a template rendered with the params.  If
+	// the map is built by another collection of the same cache, that collection is built
+	// first.
+	From  string       `yaml:"from"`
+	Steps []DeriveStep `yaml:"steps"`
+}
+
+// DeriveStep is a step applied to the entries of a derived collection.  Exactly one of its
+// fields is set.
+type DeriveStep struct {
+	// Invert swaps the key and value of each entry.
+	Invert bool `yaml:"invert"`
+	// Compose names a map that each entry's value is looked up in, replacing the value
+	// with the one from that map.  Entries whose value isn't in the map are dropped.  It
+	// is a template rendered with the params.
+	Compose string `yaml:"compose"`
+	// Filter is an expression evaluated against each entry, as a document with the fields
+	// key and val.  Entries for which it is falsy are dropped.
+	Filter string `yaml:"filter"`
+}
+
+// validate checks that exactly one field of the step is set.
+func (s DeriveStep) validate() error {
+	set := 0
+	for _, isSet := range []bool{s.Invert, s.Compose != "", s.Filter != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("each step must set exactly one of invert, compose or filter")
+	}
+	return nil
+}
+
+// derivedIter is a MongoIter over the entries of a map, with the steps of a DeriveConfig
+// applied to them.  Steps are applied a page of entries at a time, so that each compose
+// step looks up a page of values at once.
+type derivedIter struct {
+	// from is the name of the map being read
+	from    string
+	ctx     context.Context
+	client  *client.Client
+	scanner *client.Scanner
+	steps   []derivedStep
+	docs    []bson.M
+	err     error
+}
+
+// derivedStep is a DeriveStep with its templates rendered and its filter parsed.
+type derivedStep struct {
+	invert  bool
+	compose string
+	filter  *Expression
+}
+
+// newDerivedIter creates a derivedIter over the entries of the map named by derive.From,
+// read through c.
+func newDerivedIter(ctx context.Context, c *client.Client, derive DeriveConfig, params Params) (*derivedIter, error) {
+	from, err := ApplyTemplate(derive.From, params.Bson())
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]derivedStep, len(derive.Steps))
+	for ix, step := range derive.Steps {
+		if err := step.validate(); err != nil {
+			return nil, err
+		}
+		steps[ix].invert = step.Invert
+		if step.Compose != "" {
+			if steps[ix].compose, err = ApplyTemplate(step.Compose, params.Bson()); err != nil {
+				return nil, err
+			}
+		}
+		if step.Filter != "" {
+			if steps[ix].filter, err = ParseExpression(step.Filter); err != nil {
+				return nil, fmt.Errorf("invalid filter: %s", err)
+			}
+		}
+	}
+	return &derivedIter{from: from, ctx: ctx, client: c, scanner: c.NewScanner(from), steps: steps}, nil
+}
+
+// maps returns the names of the maps the iterator reads: the map it derives from, and the
+// maps of its compose steps.
+func (it *derivedIter) maps() []string {
+	names := []string{it.from}
+	for _, step := range it.steps {
+		if step.compose != "" {
+			names = append(names, step.compose)
+		}
+	}
+	return names
+}
+
+// Next sets result, which must be a *bson.M, to the next entry.
+func (it *derivedIter) Next(result interface{}) bool {
+	for len(it.docs) == 0 {
+		if it.err != nil {
+			return false
+		}
+		entries, err := it.scanner.Next(it.ctx)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if entries == nil {
+			return false
+		}
+		if it.docs, it.err = it.apply(entries); it.err != nil {
+			return false
+		}
+	}
+	*result.(*bson.M) = it.docs[0]
+	it.docs = it.docs[1:]
+	return true
+}
+
+// apply applies the steps to a page of entries, returning the documents for those that
+// remain.
+func (it *derivedIter) apply(entries []client.Entry) ([]bson.M, error) {
+	for _, step := range it.steps {
+		kept := entries[:0]
+		switch {
+		case step.invert:
+			for _, entry := range entries {
+				kept = append(kept, client.Entry{Key: entry.Value, Value: entry.Key})
+			}
+		case step.compose != "":
+			vals := make([]string, len(entries))
+			for ix, entry := range entries {
+				vals[ix] = entry.Value
+			}
+			composed, err := it.client.LookupMany(it.ctx, step.compose, vals)
+			if err == client.ErrNoMap {
+				return nil, fmt.Errorf("map %s does not exist", step.compose)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if val, ok := composed[entry.Value]; ok {
+					kept = append(kept, client.Entry{Key: entry.Key, Value: val})
+				}
+			}
+		default:
+			for _, entry := range entries {
+				matches, err := step.filter.Eval(bson.M{"key": entry.Key, "val": entry.Value})
+				if err != nil {
+					return nil, fmt.Errorf("filter: %s", err)
+				}
+				if exprTruthy(matches) {
+					kept = append(kept, entry)
+				}
+			}
+		}
+		entries = kept
+	}
+	docs := make([]bson.M, len(entries))
+	for ix, entry := range entries {
+		docs[ix] = bson.M{"key": entry.Key, "val": entry.Value}
+	}
+	return docs, nil
+}
+
+func (it *derivedIter) Err() error {
+	return it.err
+}
+
+func (it *derivedIter) Close() error {
+	it.docs = nil
+	return nil
+}
@@ -0,0 +1,67 @@
+package moredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Clever/moredis/client"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDerivedIter(t *testing.T) {
+	redigomock.Clear()
+	redigomock.GenericCommand("EVALSHA").Expect([]interface{}{
+		[]byte("moredis:maps:1"), []byte("0"),
+		[]interface{}{[]byte("a@x.com"), []byte("1"), []byte("b@x.com"), []byte("2"), []byte("c@y.com"), []byte("3")},
+	})
+	derive := DeriveConfig{
+		From: "users:email:{{.env}}",
+		Steps: []DeriveStep{
+			{Filter: `endsWith(key, "@x.com")`},
+			{Invert: true},
+		},
+	}
+	iter, err := newDerivedIter(context.Background(), client.New(mockPool{}), derive, Params{"env": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, "users:email:prod", iter.from)
+
+	docs := []bson.M{}
+	var doc bson.M
+	for iter.Next(&doc) {
+		docs = append(docs, doc)
+	}
+	assert.NoError(t, iter.Err())
+	assert.NoError(t, iter.Close())
+	assert.Equal(t, []bson.M{{"key": "1", "val": "a@x.com"}, {"key": "2", "val": "b@x.com"}}, docs)
+}
+
+func TestDerivedIterErrors(t *testing.T) {
+	c := client.New(mockPool{})
+	_, err := newDerivedIter(context.Background(), c, DeriveConfig{From: "a", Steps: []DeriveStep{{}}}, Params{})
+	assert.EqualError(t, err, "each step must set exactly one of invert, compose or filter")
+	_, err = newDerivedIter(context.Background(), c, DeriveConfig{From: "a", Steps: []DeriveStep{{Filter: "key =="}}}, Params{})
+	assert.EqualError(t, err, "invalid filter: unexpected end of expression at column 7")
+
+	redigomock.Clear()
+	redigomock.GenericCommand("EVALSHA").Expect(nil)
+	iter, err := newDerivedIter(context.Background(), c, DeriveConfig{From: "nope"}, Params{})
+	assert.NoError(t, err)
+	var doc bson.M
+	assert.False(t, iter.Next(&doc))
+	assert.Equal(t, client.ErrNoMap, iter.Err())
+}
+
+func TestOrderCollectionsDerived(t *testing.T) {
+	collections := []CollectionConfig{
+		{Derive: &DeriveConfig{From: "users:email", Steps: []DeriveStep{{Compose: "schools:name"}}},
+			Maps: []MapConfig{{Name: "users:id"}}},
+		{Collection: "schools", Maps: []MapConfig{{Name: "schools:name"}}},
+		{Collection: "users", Maps: []MapConfig{{Name: "users:email"}}},
+	}
+	order, deps, err := orderCollections(collections, Params{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 0}, order)
+	assert.Equal(t, [][]int{{2, 1}, nil, nil}, deps)
+}
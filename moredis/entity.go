@@ -0,0 +1,178 @@
+package moredis
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/Clever/moredis/logger"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MapKindEntity is the MapMetadata.Kind of entity maps.
+const MapKindEntity = "entity"
+
+// entityScanCount is the number of keys asked for with each SCAN when deleting the
+// entities of a map's old build.
+const entityScanCount = 1000
+
+// EntityKey returns the key of the redis hash holding the entity with the given key, in
+// the build of an entity map stored under hashKey.  The map's name refers to hashKey as
+// for other maps, so swapping the reference swaps every entity at once.
+func EntityKey(hashKey, key string) string {
+	return hashKey + ":entity:" + key
+}
+
+// parseFields parses the field templates of an entity map, in order of field name.
+func parseFields(rmap *MapConfig, named map[string]string, funcs template.FuncMap) error {
+	names := make([]string, 0, len(rmap.Fields))
+	for name := range rmap.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rmap.FieldNames = names
+	rmap.FieldTemplates = make([]*template.Template, len(names))
+	for ix, name := range names {
+		tmpl, err := newTemplate(rmap.HashKey+":fields."+name, rmap.Fields[name], funcs, named)
+		if err != nil {
+			return err
+		}
+		rmap.FieldTemplates[ix] = tmpl
+	}
+	return nil
+}
+
+// processEntity renders the fields of an entity map against data and writes them to the
+// entity's hash, setting when it expires.  keyMissing reports whether the key template used a missing field.
+func (p *queryProcessor) processEntity(ix int, rmap MapConfig, key string, keyMissing bool, data bson.M) error {
+	mapReport := &p.report.Maps[ix]
+	renderStart := time.Now()
+	args := make([]interface{}, 0, 1+2*len(rmap.FieldNames))
+	args = append(args, EntityKey(rmap.HashKey, key))
+	missing := false
+	for fix, name := range rmap.FieldNames {
+		val, valMissing, err := p.execute(rmap, rmap.FieldTemplates[fix], data)
+		missing = missing || valMissing
+		if err != nil {
+			p.report.Timings.Render += time.Since(renderStart)
+			if missing && !keyMissing {
+				mapReport.Missing++
+			}
+			if valMissing && rmap.Missing == MissingSkip {
+				p.skip(ix, "missing")
+				return nil
+			}
+			p.metrics.TemplateError(p.cache, rmap.Name, "fields."+name)
+			p.log.Error("Could not execute field template", err)
+			mapReport.Error = err.Error()
+			return err
+		}
+		args = append(args, name, val)
+	}
+	expireAt, expires, err := p.renderExpires(ix, rmap, data)
+	p.report.Timings.Render += time.Since(renderStart)
+	if missing && !keyMissing {
+		mapReport.Missing++
+	}
+	if err != nil {
+		return err
+	}
+	if expires && !expireAt.After(time.Now()) {
+		p.skip(ix, "expired")
+		return nil
+	}
+
+	writeStart := time.Now()
+	if err := p.writer.Send("HMSET", args...); err != nil {
+		p.log.Error("Could not send HMSET", err)
+		mapReport.Error = err.Error()
+		return err
+	}
+	p.report.Timings.Write += time.Since(writeStart)
+	p.metrics.EntryWritten(p.cache, rmap.Name)
+	mapReport.EntriesWritten++
+	for fix := 2; fix < len(args); fix += 2 {
+		p.checksums[ix].add(key+"\x00"+args[fix-1].(string), args[fix].(string))
+	}
+	// entities expire when their expires template says, or else after the map's ttl
+	switch {
+	case expires:
+		return p.sendExpiry(ix, "PEXPIREAT", args[0], epochMillis(expireAt))
+	case rmap.TTLDuration > 0:
+		return p.sendExpiry(ix, "PEXPIRE", args[0], int64(rmap.TTLDuration/time.Millisecond))
+	}
+	return nil
+}
+
+// deleteEntities deletes the entities of the build of an entity map stored under hashKey.
+// The keyspace is scanned a page at a time, so redis isn't blocked while a large map is
+// deleted.
+func deleteEntities(conn redis.Conn, log Logger, hashKey string) error {
+	pattern := EntityKey(hashKey, "*")
+	cursor, deleted := "0", 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", entityScanCount))
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Values(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+			deleted += len(keys)
+		}
+		if cursor == "0" {
+			log.Info("Deleted old entities", logger.M{"map": hashKey, "deleted": deleted})
+			return nil
+		}
+	}
+}
+
+// entityMapError is returned when an entity map is read as a single hash, which it isn't
+// stored in.
+type entityMapError struct {
+	mapName string
+}
+
+func (e entityMapError) Error() string {
+	return fmt.Sprintf("map %s is an entity map, which can't be read as a single hash", e.mapName)
+}
+
+// isEntityMap reports whether the build of a map stored under hashKey is an entity map,
+// according to its metadata.
+func isEntityMap(conn redis.Conn, hashKey string) (bool, error) {
+	kind, err := redis.String(conn.Do("HGET", MetadataKey(hashKey), "kind"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return kind == MapKindEntity, err
+}
+
+// checkHashMap returns an entityMapError if mapName currently refers to an entity map.
+// Maps that don't exist pass, for the reads that follow to report.
+func checkHashMap(conn redis.Conn, mapName string) error {
+	hashKey, err := redis.String(conn.Do("GET", mapName))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entity, err := isEntityMap(conn, hashKey)
+	if err != nil {
+		return err
+	}
+	if entity {
+		return entityMapError{mapName}
+	}
+	return nil
+}
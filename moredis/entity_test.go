@@ -0,0 +1,95 @@
+package moredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestProcessQueryEntities(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "email": "a@x.com", "name": "alice"},
+		{"_id": "2", "email": "b@x.com"},
+	})
+	collection := CollectionConfig{
+		Maps: []MapConfig{{
+			Key:     "{{._id}}",
+			Fields:  map[string]string{"name": "{{.name}}", "email": "{{toUpper .email}}"},
+			Missing: MissingSkip,
+			HashKey: "moredis:maps:1",
+		}},
+	}
+	redigomock.Clear()
+	redigomock.Command("HMSET", "moredis:maps:1:entity:1", "email", "A@X.COM", "name", "alice").Expect("OK")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	assert.Equal(t, []string{"email", "name"}, collection.Maps[0].FieldNames)
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"missing": 1}, report.Maps[0].Skipped)
+	assert.Equal(t, 1, report.Maps[0].Missing)
+}
+
+func TestUpdateRedisMapReferenceEntities(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GETSET", "user", "moredis:maps:2").Expect("moredis:maps:1")
+	redigomock.Command("DEL", "moredis:maps:1", "moredis:maps:1:meta").Expect(int64(0))
+	redigomock.Command("SCAN", "0", "MATCH", "moredis:maps:1:entity:*", "COUNT", entityScanCount).
+		Expect([]interface{}{[]byte("7"), []interface{}{[]byte("moredis:maps:1:entity:1")}})
+	redigomock.Command("SCAN", "7", "MATCH", "moredis:maps:1:entity:*", "COUNT", entityScanCount).
+		Expect([]interface{}{[]byte("0"), []interface{}{[]byte("moredis:maps:1:entity:2"), []byte("moredis:maps:1:entity:3")}})
+	redigomock.Command("DEL", []byte("moredis:maps:1:entity:1")).Expect(int64(1))
+	redigomock.Command("DEL", []byte("moredis:maps:1:entity:2"), []byte("moredis:maps:1:entity:3")).Expect(int64(2))
+
+	rmap := MapConfig{Name: "user", HashKey: "moredis:maps:2", Fields: map[string]string{"email": "{{.email}}"}}
+	assert.NoError(t, UpdateRedisMapReference(redigomock.NewConn(), Params{}, rmap))
+
+	redigomock.Clear()
+	redigomock.Command("GETSET", "user", "moredis:maps:2").Expect("moredis:maps:1")
+	redigomock.Command("DEL", "moredis:maps:1", "moredis:maps:1:meta").Expect(int64(0))
+	redigomock.GenericCommand("SCAN").ExpectError(redis.Error("ERR boom"))
+	// the map has already been swapped, so failing to delete the old entities is only logged
+	log := &recordingLogger{}
+	mapName, oldMap, err := updateRedisMapReference(redigomock.NewConn(), log, Params{}, rmap)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", mapName)
+	assert.Equal(t, "moredis:maps:1", oldMap)
+	assert.Contains(t, log.titles, "Failed to delete old entities")
+}
+
+func TestCheckHashMap(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	redigomock.Command("HGET", "moredis:maps:1:meta", "kind").ExpectError(redis.ErrNil)
+	redigomock.Command("GET", "user").Expect("moredis:maps:2")
+	redigomock.Command("HGET", "moredis:maps:2:meta", "kind").Expect(MapKindEntity)
+	redigomock.Command("GET", "nope").ExpectError(redis.ErrNil)
+	conn := redigomock.NewConn()
+
+	assert.NoError(t, checkHashMap(conn, "users"))
+	assert.EqualError(t, checkHashMap(conn, "user"), "map user is an entity map, which can't be read as a single hash")
+	assert.NoError(t, checkHashMap(conn, "nope"))
+}
+
+func TestBuilderDeriveFromEntityMap(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("INCR", "moredis:mapindexcounter").Expect(int64(3))
+	redigomock.Command("GET", "user").Expect("moredis:maps:2")
+	redigomock.Command("HGET", "moredis:maps:2:meta", "kind").Expect(MapKindEntity)
+
+	b := newTestBuilder(nil, WithLogger(&recordingLogger{}))
+	config := Config{
+		Name: "test",
+		Collections: []CollectionConfig{{
+			Derive: &DeriveConfig{From: "user"},
+			Maps:   []MapConfig{{Name: "user:inverted", Key: "{{.val}}", Value: "{{.key}}"}},
+		}},
+	}
+	_, err := b.Build(context.Background(), config, Params{})
+	assert.EqualError(t, err, "map user is an entity map, which can't be read as a single hash")
+}
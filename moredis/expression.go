@@ -0,0 +1,822 @@
+package moredis
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Expression is a parsed computed field expression.  Expressions are a small, side effect
+// free language over the fields of a document:
+//
+//	address.city ?? "unknown"             fields by dotted path, with null coalescing
+//	qty * price - discount                arithmetic: + - * / %
+//	first + " " + last                    + concatenates when either side is a string
+//	active && (age >= 18 || guardian)     comparisons and boolean logic
+//	plan == "pro" ? "paid" : "free"       conditionals
+//	lower(trim(email))                    function calls
+//
+// Missing fields are null.  Arithmetic and functions on null give null, so that a null
+// can be replaced with ??.
+type Expression struct {
+	text string
+	root exprNode
+}
+
+// ParseExpression parses an expression.
+func ParseExpression(text string) (*Expression, error) {
+	p := &exprParser{text: text}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return &Expression{text: text, root: root}, nil
+}
+
+// Eval evaluates the expression against a document.  Whole numbers come back as int64, so
+// that templates render them without an exponent.
+func (e *Expression) Eval(doc bson.M) (interface{}, error) {
+	val, err := e.root.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if num, ok := val.(float64); ok && num == math.Trunc(num) && math.Abs(num) < 1<<63 {
+		return int64(num), nil
+	}
+	return val, nil
+}
+
+// Paths returns the dotted paths of the document fields that the expression uses.
+func (e *Expression) Paths() []string {
+	paths := []string{}
+	e.root.paths(func(path string) { paths = append(paths, path) })
+	return paths
+}
+
+func (e *Expression) String() string {
+	return e.text
+}
+
+type exprNode interface {
+	eval(doc bson.M) (interface{}, error)
+	paths(add func(string))
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n literalNode) eval(doc bson.M) (interface{}, error) { return n.val, nil }
+func (n literalNode) paths(add func(string))               {}
+
+type pathNode struct {
+	path     string
+	segments []string
+}
+
+func (n pathNode) eval(doc bson.M) (interface{}, error) {
+	return pathValue(doc, n.segments), nil
+}
+
+// pathValue returns the value at a path in a document, where numeric segments index
+// arrays.  It returns nil if there is nothing at the path.
+func pathValue(doc bson.M, segments []string) interface{} {
+	var val interface{} = doc
+	for _, segment := range segments {
+		switch current := val.(type) {
+		case bson.M:
+			val = current[segment]
+		case map[string]interface{}:
+			val = current[segment]
+		case []interface{}:
+			ix, err := strconv.Atoi(segment)
+			if err != nil || ix < 0 || ix >= len(current) {
+				return nil
+			}
+			val = current[ix]
+		default:
+			return nil
+		}
+	}
+	return val
+}
+
+func (n pathNode) paths(add func(string)) { add(n.path) }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(doc bson.M) (interface{}, error) {
+	val, err := n.operand.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !exprTruthy(val), nil
+	}
+	if val == nil {
+		return nil, nil
+	}
+	if integer, ok := asInteger(val); ok {
+		return -integer, nil
+	}
+	num, ok := asNumber(val)
+	if !ok {
+		return nil, fmt.Errorf("can't negate %s", describe(val))
+	}
+	return -num, nil
+}
+
+func (n unaryNode) paths(add func(string)) { n.operand.paths(add) }
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(doc bson.M) (interface{}, error) {
+	left, err := n.left.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	// the logical operators only evaluate their right side if they need to
+	switch n.op {
+	case "??":
+		if left != nil {
+			return left, nil
+		}
+		return n.right.eval(doc)
+	case "&&":
+		if !exprTruthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(doc)
+		return exprTruthy(right), err
+	case "||":
+		if exprTruthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(doc)
+		return exprTruthy(right), err
+	}
+	right, err := n.right.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return exprCompare(n.op, left, right), nil
+	}
+	return arithmetic(n.op, left, right)
+}
+
+func (n binaryNode) paths(add func(string)) {
+	n.left.paths(add)
+	n.right.paths(add)
+}
+
+type ternaryNode struct {
+	cond, then, otherwise exprNode
+}
+
+func (n ternaryNode) eval(doc bson.M) (interface{}, error) {
+	cond, err := n.cond.eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(cond) {
+		return n.then.eval(doc)
+	}
+	return n.otherwise.eval(doc)
+}
+
+func (n ternaryNode) paths(add func(string)) {
+	n.cond.paths(add)
+	n.then.paths(add)
+	n.otherwise.paths(add)
+}
+
+type callNode struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+}
+
+func (n callNode) eval(doc bson.M) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for ix, arg := range n.args {
+		val, err := arg.eval(doc)
+		if err != nil {
+			return nil, err
+		}
+		args[ix] = val
+	}
+	val, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err)
+	}
+	return val, nil
+}
+
+func (n callNode) paths(add func(string)) {
+	for _, arg := range n.args {
+		arg.paths(add)
+	}
+}
+
+// exprTruthy reports whether a value counts as true in conditions.
+func exprTruthy(val interface{}) bool {
+	switch val := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case string:
+		return val != ""
+	}
+	if num, ok := asNumber(val); ok {
+		return num != 0
+	}
+	return true
+}
+
+// asNumber converts the numeric types found in documents to float64.
+func asNumber(val interface{}) (float64, bool) {
+	switch val := val.(type) {
+	case int:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case float32:
+		return float64(val), true
+	case float64:
+		return val, true
+	}
+	return 0, false
+}
+
+// asInteger converts the integer types found in documents to int64.
+func asInteger(val interface{}) (int64, bool) {
+	switch val := val.(type) {
+	case int:
+		return int64(val), true
+	case int32:
+		return int64(val), true
+	case int64:
+		return val, true
+	}
+	return 0, false
+}
+
+func exprEqual(left, right interface{}) bool {
+	if l, ok := asNumber(left); ok {
+		r, ok := asNumber(right)
+		return ok && l == r
+	}
+	if l, ok := asString(left); ok {
+		r, ok := asString(right)
+		return ok && l == r
+	}
+	if l, ok := left.(time.Time); ok {
+		r, ok := right.(time.Time)
+		return ok && l.Equal(r)
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// exprCompare orders numbers, strings and dates.  Other values, including nulls, are
+// never less or greater than anything.
+func exprCompare(op string, left, right interface{}) bool {
+	var cmp int
+	if l, ok := asNumber(left); ok {
+		r, ok := asNumber(right)
+		if !ok {
+			return false
+		}
+		cmp = compareFloats(l, r)
+	} else if l, ok := asString(left); ok {
+		r, ok := asString(right)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	} else if l, ok := left.(time.Time); ok {
+		r, ok := right.(time.Time)
+		if !ok {
+			return false
+		}
+		cmp = compareFloats(float64(l.UnixNano()), float64(r.UnixNano()))
+	} else {
+		return false
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// arithmetic applies + - * / or % to two values.  + concatenates if either side is a
+// string.  Either side being null gives null.
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	if op == "+" {
+		_, leftStr := left.(string)
+		_, rightStr := right.(string)
+		if leftStr || rightStr {
+			return toString(left) + toString(right), nil
+		}
+	}
+	if l, lok := asInteger(left); lok {
+		if r, rok := asInteger(right); rok {
+			return integerArithmetic(op, l, r)
+		}
+	}
+	l, lok := asNumber(left)
+	r, rok := asNumber(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("can't apply %s to %s and %s", op, describe(left), describe(right))
+	}
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+// integerArithmetic applies op to two integers, keeping the result an integer unless a
+// division isn't exact.
+func integerArithmetic(op string, l, r int64) (interface{}, error) {
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if op == "/" {
+		if l%r != 0 {
+			return float64(l) / float64(r), nil
+		}
+		return l / r, nil
+	}
+	return l % r, nil
+}
+
+// describe names the type of a value for error messages.
+func describe(val interface{}) string {
+	switch val.(type) {
+	case string:
+		return "a string"
+	case int, int32, int64, float32, float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case bson.M, map[string]interface{}:
+		return "a document"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("a %T", val)
+}
+
+// exprFunc is a function that can be called from expressions.
+type exprFunc struct {
+	// arity is the number of arguments the function takes, or -1 for any number
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+// stringExprFunc wraps a string function so that it gives null for a null argument.
+func stringExprFunc(fn func(string) string) exprFunc {
+	return exprFunc{1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return fn(toString(args[0])), nil
+	}}
+}
+
+// numberExprFunc wraps a numeric function so that it gives null for a null argument.
+func numberExprFunc(fn func(float64) float64) exprFunc {
+	return exprFunc{1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		num, ok := asNumber(args[0])
+		if !ok {
+			return nil, fmt.Errorf("expected a number, got %s", describe(args[0]))
+		}
+		return fn(num), nil
+	}}
+}
+
+// stringTestExprFunc wraps a test of a string against a substring.
+func stringTestExprFunc(fn func(s, substr string) bool) exprFunc {
+	return exprFunc{2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return false, nil
+		}
+		return fn(toString(args[0]), toString(args[1])), nil
+	}}
+}
+
+// exprFuncs are the functions that can be called from expressions.
+var exprFuncs = map[string]exprFunc{
+	"lower":      stringExprFunc(strings.ToLower),
+	"upper":      stringExprFunc(strings.ToUpper),
+	"trim":       stringExprFunc(strings.TrimSpace),
+	"string":     stringExprFunc(func(s string) string { return s }),
+	"contains":   stringTestExprFunc(strings.Contains),
+	"startsWith": stringTestExprFunc(strings.HasPrefix),
+	"endsWith":   stringTestExprFunc(strings.HasSuffix),
+	"round":      numberExprFunc(math.Round),
+	"floor":      numberExprFunc(math.Floor),
+	"ceil":       numberExprFunc(math.Ceil),
+	"abs":        numberExprFunc(math.Abs),
+	"replace": {3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return strings.Replace(toString(args[0]), toString(args[1]), toString(args[2]), -1), nil
+	}},
+	"len": {1, func(args []interface{}) (interface{}, error) {
+		switch val := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return int64(utf8.RuneCountInString(val)), nil
+		case []interface{}:
+			return int64(len(val)), nil
+		case bson.M:
+			return int64(len(val)), nil
+		}
+		return nil, fmt.Errorf("expected a string, array or document, got %s", describe(args[0]))
+	}},
+	"number": {1, func(args []interface{}) (interface{}, error) {
+		if num, ok := asNumber(args[0]); ok {
+			return num, nil
+		}
+		str, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		num, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, nil
+		}
+		return num, nil
+	}},
+	"min": {-1, func(args []interface{}) (interface{}, error) {
+		return extremum(args, func(a, b float64) bool { return a < b })
+	}},
+	"max": {-1, func(args []interface{}) (interface{}, error) {
+		return extremum(args, func(a, b float64) bool { return a > b })
+	}},
+}
+
+// extremum returns the number in args that beats all the others, ignoring nulls.
+func extremum(args []interface{}, beats func(a, b float64) bool) (interface{}, error) {
+	var best interface{}
+	var bestNum float64
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		num, ok := asNumber(arg)
+		if !ok {
+			return nil, fmt.Errorf("expected numbers, got %s", describe(arg))
+		}
+		if best == nil || beats(num, bestNum) {
+			best, bestNum = arg, num
+		}
+	}
+	return best, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// val is the value of number and string literals
+	val interface{}
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprOps are the operators, longest first so that they're matched greedily.
+var exprOps = []string{"??", "||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "?", ":", "(", ")", ","}
+
+type exprParser struct {
+	text   string
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at column %d", fmt.Sprintf(format, args...), tok.pos+1)
+}
+
+// lex splits the expression into tokens.
+func (p *exprParser) lex() error {
+	text := p.text
+	for ix := 0; ix < len(text); {
+		c, size := utf8.DecodeRuneInString(text[ix:])
+		switch {
+		case unicode.IsSpace(c):
+			ix += size
+		case c >= '0' && c <= '9':
+			end := ix
+			for end < len(text) && (text[end] >= '0' && text[end] <= '9' || text[end] == '.') {
+				end++
+			}
+			var num interface{}
+			if integer, err := strconv.ParseInt(text[ix:end], 10, 64); err == nil {
+				num = integer
+			} else if float, err := strconv.ParseFloat(text[ix:end], 64); err == nil {
+				num = float
+			} else {
+				return p.errorf(token{pos: ix}, "invalid number %q", text[ix:end])
+			}
+			p.tokens = append(p.tokens, token{tokNumber, text[ix:end], ix, num})
+			ix = end
+		case c == '"' || c == '\'':
+			end := ix + 1
+			for end < len(text) && text[end] != byte(c) {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return p.errorf(token{pos: ix}, "unterminated string")
+			}
+			raw := text[ix+1 : end]
+			str := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\'`, `'`, `\n`, "\n", `\t`, "\t").Replace(raw)
+			p.tokens = append(p.tokens, token{tokString, text[ix : end+1], ix, str})
+			ix = end + 1
+		case c == '_' || c == '$' || unicode.IsLetter(c):
+			end := ix
+			for end < len(text) {
+				r, size := utf8.DecodeRuneInString(text[end:])
+				if !isPathChar(r) {
+					break
+				}
+				end += size
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: text[ix:end], pos: ix})
+			ix = end
+		default:
+			matched := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(text[ix:], op) {
+					p.tokens = append(p.tokens, token{kind: tokOp, text: op, pos: ix})
+					ix += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return p.errorf(token{pos: ix}, "unexpected character %q", c)
+			}
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokEOF, pos: len(text)})
+	return nil
+}
+
+func isPathChar(c rune) bool {
+	return c == '_' || c == '$' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the operators ops.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		tok := p.peek()
+		return p.errorf(tok, "expected %q, found %s", op, tok)
+	}
+	return nil
+}
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return ternaryNode{cond, then, otherwise}, nil
+}
+
+// binaryPrecedence lists the binary operators from the loosest binding to the tightest.
+var binaryPrecedence = [][]string{
+	{"??"},
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(binaryPrecedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber, tokString:
+		return literalNode{tok.val}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+		if strings.HasPrefix(tok.text, ".") || strings.HasSuffix(tok.text, ".") || strings.Contains(tok.text, "..") {
+			return nil, p.errorf(tok, "invalid field path %s", tok)
+		}
+		return pathNode{tok.text, strings.Split(tok.text, ".")}, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+	}
+	return nil, p.errorf(tok, "unexpected %s", tok)
+}
+
+// parseCall parses the arguments of a call to the function named by tok.
+func (p *exprParser) parseCall(tok token) (exprNode, error) {
+	fn, ok := exprFuncs[tok.text]
+	if !ok {
+		return nil, p.errorf(tok, "unknown function %s", tok)
+	}
+	args := []exprNode{}
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(")"); ok {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if fn.arity >= 0 && len(args) != fn.arity {
+		return nil, p.errorf(tok, "%s takes %d arguments, got %d", tok.text, fn.arity, len(args))
+	}
+	return callNode{tok.text, fn, args}, nil
+}
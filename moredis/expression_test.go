@@ -0,0 +1,128 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type expressionTestSpec struct {
+	expr     string
+	expected interface{}
+}
+
+var expressionDoc = bson.M{
+	"first":   "Ada",
+	"last":    "Lovelace",
+	"email":   "  Ada@Example.COM ",
+	"qty":     3,
+	"price":   2.5,
+	"count":   int64(10),
+	"città":   "Roma",
+	"active":  true,
+	"empty":   "",
+	"address": bson.M{"city": "London", "zip": nil},
+	"tags":    []interface{}{"a", "b"},
+	"created": time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+	"updated": time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC),
+}
+
+var expressionTests = []expressionTestSpec{
+	{`first + " " + last`, "Ada Lovelace"},
+	{`qty * price`, 7.5},
+	{`count / 4 - 1`, 1.5},
+	{`count % 3`, int64(1)},
+	{`-qty + 1`, int64(-2)},
+	{`2 + 3 * 4`, int64(14)},
+	{`(2 + 3) * 4`, int64(20)},
+	{`count / 5`, int64(2)},
+	{`qty * 411522 + 1`, int64(1234567)},
+	{`count + 9007199254740993`, int64(9007199254741003)},
+	{`price * 2`, int64(5)},
+	{`"n" + qty`, "n3"},
+	{`missing + 1`, nil},
+	{`missing ?? "none"`, "none"},
+	{`address.zip ?? address.city`, "London"},
+	{`address.street.name ?? "unknown"`, "unknown"},
+	{`tags.1`, "b"},
+	{`tags.5 ?? "-"`, "-"},
+	{`qty > 2 && active`, true},
+	{`qty > 2 && empty`, false},
+	{`!active || missing`, false},
+	{`qty == 3`, true},
+	{`first != "Ada"`, false},
+	{`missing == null`, true},
+	{`missing < 1`, false},
+	{`created < updated`, true},
+	{`"a" < "b"`, true},
+	{`active ? "yes" : "no"`, "yes"},
+	{`qty > 5 ? "many" : qty > 1 ? "some" : "one"`, "some"},
+	{`lower(trim(email))`, "ada@example.com"},
+	{`upper(missing)`, nil},
+	{`len(tags) + len(first)`, int64(5)},
+	{`len("Zoë")`, int64(3)},
+	{`città + " è"`, "Roma è"},
+	{`contains(email, "@")`, true},
+	{`startsWith(last, "Love")`, true},
+	{`replace(first, "a", "4")`, "Ad4"},
+	{`round(price)`, int64(3)},
+	{`number("12.5") + 1`, 13.5},
+	{`max(qty, missing, count)`, int64(10)},
+	{`min(qty, price)`, 2.5},
+	{`'single \'quoted\''`, "single 'quoted'"},
+}
+
+func TestExpressionEval(t *testing.T) {
+	for _, spec := range expressionTests {
+		expr, err := ParseExpression(spec.expr)
+		if !assert.NoError(t, err, spec.expr) {
+			continue
+		}
+		val, err := expr.Eval(expressionDoc)
+		assert.NoError(t, err, spec.expr)
+		assert.Equal(t, spec.expected, val, spec.expr)
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	for expr, expected := range map[string]string{
+		`first - 1`:    "can't apply - to a string and a number",
+		`qty / 0`:      "division by zero",
+		`-first`:       "can't negate a string",
+		`round(first)`: "round: expected a number, got a string",
+	} {
+		parsed, err := ParseExpression(expr)
+		if !assert.NoError(t, err, expr) {
+			continue
+		}
+		_, err = parsed.Eval(expressionDoc)
+		assert.EqualError(t, err, expected, expr)
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for expr, expected := range map[string]string{
+		`qty +`:           "unexpected end of expression at column 6",
+		`(qty`:            `expected ")", found end of expression at column 5`,
+		`qty qty`:         `unexpected "qty" at column 5`,
+		`nope(qty)`:       `unknown function "nope" at column 1`,
+		`lower(a, b)`:     "lower takes 1 arguments, got 2 at column 1",
+		`"open`:           "unterminated string at column 1",
+		`qty # 2`:         "unexpected character '#' at column 5",
+		`active ? 1`:      `expected ":", found end of expression at column 11`,
+		`address..city`:   `invalid field path "address..city" at column 1`,
+		`1.2.3`:           `invalid number "1.2.3" at column 1`,
+		`qty == 1 ?? ) 2`: `unexpected ")" at column 13`,
+	} {
+		_, err := ParseExpression(expr)
+		assert.EqualError(t, err, expected, expr)
+	}
+}
+
+func TestExpressionPaths(t *testing.T) {
+	expr, err := ParseExpression(`lower(a.b ?? c) + (d ? e.f : "x") + len(g)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.b", "c", "d", "e.f", "g"}, expr.Paths())
+}
@@ -0,0 +1,272 @@
+package moredis
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The functions in this file are exported to templates by funcMap.  Like safeToLower, the
+// string functions accept strings and the bson types that have a natural string form
+// (ObjectIds, Decimal128s and binary UUIDs), and treat anything else as the empty string,
+// so that missing or unexpected fields give empty keys rather than template errors.
+
+// asString converts strings and string-like bson values to strings.  The second return
+// value is false for any other type.
+func asString(toConvert interface{}) (string, bool) {
+	switch toConvert := toConvert.(type) {
+	case string:
+		return toConvert, true
+	case bson.ObjectId:
+		return toConvert.Hex(), true
+	case bson.Decimal128:
+		return toConvert.String(), true
+	case bson.Binary:
+		return formatUUID(toConvert)
+	default:
+		return "", false
+	}
+}
+
+// formatUUID formats binary UUIDs (subtypes 3 and 4) in their canonical hex form.
+func formatUUID(bin bson.Binary) (string, bool) {
+	if (bin.Kind != 0x03 && bin.Kind != 0x04) || len(bin.Data) != 16 {
+		return "", false
+	}
+	h := hex.EncodeToString(bin.Data)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], true
+}
+
+// stringFunc wraps a func(string) string so that it can be exported to templates with the
+// same handling of non-strings as safeToLower.
+func stringFunc(fn func(string) string) func(interface{}) string {
+	return func(toConvert interface{}) string {
+		str, ok := asString(toConvert)
+		if !ok {
+			return ""
+		}
+		return fn(str)
+	}
+}
+
+// replace is exported to templates as 'replace', and replaces all instances of old with repl.
+// The value comes last so that it can be used in pipelines, e.g. {{.email | replace "@" "_"}}
+func replace(old, repl string, toConvert interface{}) string {
+	str, _ := asString(toConvert)
+	return strings.Replace(str, old, repl, -1)
+}
+
+var (
+	regexpCache   = map[string]*regexp.Regexp{}
+	regexpCacheMu sync.Mutex
+)
+
+// compileRegexp compiles pattern, caching the result since templates are executed once
+// per document.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCacheMu.Lock()
+	defer regexpCacheMu.Unlock()
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// regexReplace is exported to templates as 'regexReplace', and replaces all matches of
+// pattern with repl, which can refer to submatches as $1 etc.  An invalid pattern is a
+// template error.
+func regexReplace(pattern, repl string, toConvert interface{}) (string, error) {
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return "", err
+	}
+	str, _ := asString(toConvert)
+	return re.ReplaceAllString(str, repl), nil
+}
+
+// split is exported to templates as 'split', and splits a string into an array on sep.
+func split(sep string, toConvert interface{}) []string {
+	str, ok := asString(toConvert)
+	if !ok || str == "" {
+		return []string{}
+	}
+	return strings.Split(str, sep)
+}
+
+// join is exported to templates as 'join', and joins the elements of an array with sep.
+// Elements are converted to strings with toString.  For non-arrays, this will return the
+// empty string.
+func join(sep string, toConvert interface{}) string {
+	var parts []string
+	switch toConvert := toConvert.(type) {
+	case []string:
+		parts = toConvert
+	case []interface{}:
+		parts = make([]string, 0, len(toConvert))
+		for _, elem := range toConvert {
+			parts = append(parts, toString(elem))
+		}
+	default:
+		return ""
+	}
+	return strings.Join(parts, sep)
+}
+
+// isEmpty reports whether a template value should be replaced by 'default' or skipped by
+// 'coalesce'.  Missing fields, nil and empty strings are empty.
+func isEmpty(val interface{}) bool {
+	switch val := val.(type) {
+	case nil:
+		return true
+	case string:
+		return val == ""
+	default:
+		return false
+	}
+}
+
+// defaultVal is exported to templates as 'default', and returns def if val is empty,
+// e.g. {{.nickname | default "none"}}
+func defaultVal(def, val interface{}) interface{} {
+	if isEmpty(val) {
+		return def
+	}
+	return val
+}
+
+// coalesce is exported to templates as 'coalesce', and returns the first of its arguments
+// that isn't empty, or nil if they all are.
+func coalesce(vals ...interface{}) interface{} {
+	for _, val := range vals {
+		if !isEmpty(val) {
+			return val
+		}
+	}
+	return nil
+}
+
+// substr is exported to templates as 'substr', and returns the characters of a string from
+// start up to end.  A negative end means the end of the string.  Out of range indexes are
+// clamped to the string.
+func substr(start, end int, toConvert interface{}) string {
+	str, _ := asString(toConvert)
+	runes := []rune(str)
+	if end < 0 || end > len(runes) {
+		end = len(runes)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start >= end {
+		return ""
+	}
+	return string(runes[start:end])
+}
+
+// formatNumber is exported to templates as 'formatNumber', and formats a number with a
+// fixed number of decimal places.  It accepts any numeric type, Decimal128s and numeric
+// strings, and returns the empty string for anything else.
+func formatNumber(decimals int, toConvert interface{}) string {
+	f, ok := asFloat(toConvert)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'f', decimals, 64)
+}
+
+// asFloat converts numeric values to float64.  The second return value is false for
+// non-numeric values.
+func asFloat(toConvert interface{}) (float64, bool) {
+	switch toConvert := toConvert.(type) {
+	case int:
+		return float64(toConvert), true
+	case int32:
+		return float64(toConvert), true
+	case int64:
+		return float64(toConvert), true
+	case float32:
+		return float64(toConvert), true
+	case float64:
+		return toConvert, true
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(toConvert.String(), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(toConvert, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func hashMD5(str string) string {
+	sum := md5.Sum([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashSHA1(str string) string {
+	sum := sha1.Sum([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashSHA256(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFNV returns the 64 bit FNV-1a hash of a string in hex.
+func hashFNV(str string) string {
+	h := fnv.New64a()
+	h.Write([]byte(str))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func base64Encode(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+// base64Decode returns the empty string for input that isn't valid base64.
+func base64Decode(str string) string {
+	decoded, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return ""
+	}
+	return string(decoded)
+}
+
+// urlDecode returns the empty string for input that isn't validly escaped.
+func urlDecode(str string) string {
+	decoded, err := url.QueryUnescape(str)
+	if err != nil {
+		return ""
+	}
+	return decoded
+}
+
+// normalizeEmail trims and lowercases an email address.  Strings that don't look like an
+// email address (a single @ with text on both sides) normalize to the empty string, so
+// they are skipped when used as keys.
+func normalizeEmail(str string) string {
+	email := strings.ToLower(strings.TrimSpace(str))
+	at := strings.Index(email, "@")
+	if at <= 0 || at == len(email)-1 || strings.Count(email, "@") != 1 {
+		return ""
+	}
+	return email
+}
@@ -0,0 +1,246 @@
+package moredis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testUUID = bson.Binary{
+	Kind: 0x04,
+	Data: []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0},
+}
+
+func mustDecimal(s string) bson.Decimal128 {
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+type asStringTestSpec struct {
+	input    interface{}
+	expected string
+	ok       bool
+}
+
+var asStringTests = []asStringTestSpec{
+	{"string", "string", true},
+	{bson.ObjectIdHex("ffffffffffffffffffffffff"), "ffffffffffffffffffffffff", true},
+	{mustDecimal("1.50"), "1.50", true},
+	{testUUID, "12345678-9abc-def0-1234-56789abcdef0", true},
+	{bson.Binary{Kind: 0x00, Data: []byte("bin")}, "", false},
+	{5, "", false},
+	{nil, "", false},
+}
+
+func TestAsString(t *testing.T) {
+	for _, testCase := range asStringTests {
+		actual, ok := asString(testCase.input)
+		assert.Equal(t, testCase.expected, actual, "asString(%v) failed", testCase.input)
+		assert.Equal(t, testCase.ok, ok, "asString(%v) failed", testCase.input)
+	}
+}
+
+var templateFuncTests = []applyTemplateTestSpec{
+	{
+		name:           "toUpper",
+		templateString: "{{toUpper .field}}",
+		payload:        bson.M{"field": "value"},
+		expected:       "VALUE",
+	},
+	{
+		name:           "toUpper non-string",
+		templateString: "{{toUpper .field}}",
+		payload:        bson.M{"field": 5},
+		expected:       "",
+	},
+	{
+		name:           "toUpper missing",
+		templateString: "{{toUpper .missing}}",
+		payload:        bson.M{},
+		expected:       "",
+	},
+	{
+		name:           "trim",
+		templateString: "{{trim .field}}",
+		payload:        bson.M{"field": "  value \t"},
+		expected:       "value",
+	},
+	{
+		name:           "replace",
+		templateString: `{{.field | replace "@" "_"}}`,
+		payload:        bson.M{"field": "a@b@c"},
+		expected:       "a_b_c",
+	},
+	{
+		name:           "regexReplace",
+		templateString: `{{regexReplace "[^0-9]" "" .field}}`,
+		payload:        bson.M{"field": "(555) 123-4567"},
+		expected:       "5551234567",
+	},
+	{
+		name:           "regexReplace invalid pattern",
+		templateString: `{{regexReplace "(" "" .field}}`,
+		payload:        bson.M{"field": "value"},
+		expectedError:  true,
+	},
+	{
+		name:           "split and join",
+		templateString: `{{.field | split "," | join ";"}}`,
+		payload:        bson.M{"field": "a,b,c"},
+		expected:       "a;b;c",
+	},
+	{
+		name:           "join bson array",
+		templateString: `{{join "," .field}}`,
+		payload:        bson.M{"field": []interface{}{"a", 1, bson.ObjectIdHex("ffffffffffffffffffffffff")}},
+		expected:       "a,1,ffffffffffffffffffffffff",
+	},
+	{
+		name:           "join non-array",
+		templateString: `{{join "," .field}}`,
+		payload:        bson.M{"field": "a"},
+		expected:       "",
+	},
+	{
+		name:           "default with value",
+		templateString: `{{.field | default "none"}}`,
+		payload:        bson.M{"field": "value"},
+		expected:       "value",
+	},
+	{
+		name:           "default missing",
+		templateString: `{{.missing | default "none"}}`,
+		payload:        bson.M{},
+		expected:       "none",
+	},
+	{
+		name:           "default empty string",
+		templateString: `{{.field | default "none"}}`,
+		payload:        bson.M{"field": ""},
+		expected:       "none",
+	},
+	{
+		name:           "coalesce",
+		templateString: `{{coalesce .missing .empty .field}}`,
+		payload:        bson.M{"empty": "", "field": "value"},
+		expected:       "value",
+	},
+	{
+		name:           "substr",
+		templateString: `{{substr 0 3 .field}}`,
+		payload:        bson.M{"field": "héllo"},
+		expected:       "hél",
+	},
+	{
+		name:           "substr to end",
+		templateString: `{{substr 2 -1 .field}}`,
+		payload:        bson.M{"field": "hello"},
+		expected:       "llo",
+	},
+	{
+		name:           "substr out of range",
+		templateString: `{{substr 10 20 .field}}`,
+		payload:        bson.M{"field": "hello"},
+		expected:       "",
+	},
+	{
+		name:           "formatNumber float",
+		templateString: `{{formatNumber 2 .field}}`,
+		payload:        bson.M{"field": 3.14159},
+		expected:       "3.14",
+	},
+	{
+		name:           "formatNumber decimal128",
+		templateString: `{{formatNumber 1 .field}}`,
+		payload:        bson.M{"field": mustDecimal("2.25")},
+		expected:       "2.2",
+	},
+	{
+		name:           "formatNumber int",
+		templateString: `{{formatNumber 0 .field}}`,
+		payload:        bson.M{"field": int64(42)},
+		expected:       "42",
+	},
+	{
+		name:           "formatNumber non-number",
+		templateString: `{{formatNumber 0 .field}}`,
+		payload:        bson.M{"field": "abc"},
+		expected:       "",
+	},
+	{
+		name:           "md5",
+		templateString: `{{md5 .field}}`,
+		payload:        bson.M{"field": "value"},
+		expected:       "2063c1608d6e0baf80249c42e2be5804",
+	},
+	{
+		name:           "sha1",
+		templateString: `{{sha1 .field}}`,
+		payload:        bson.M{"field": "value"},
+		expected:       "f32b67c7e26342af42efabc674d441dca0a281c5",
+	},
+	{
+		name:           "sha256",
+		templateString: `{{sha256 .field}}`,
+		payload:        bson.M{"field": "value"},
+		expected:       "cd42404d52ad55ccfa9aca4adc828aa5800ad9d385a0671fbcbf724118320619",
+	},
+	{
+		name:           "fnv",
+		templateString: `{{fnv .field}}`,
+		payload:        bson.M{"field": ""},
+		expected:       "cbf29ce484222325",
+	},
+	{
+		name:           "hash of ObjectId uses hex",
+		templateString: `{{md5 .field}}`,
+		payload:        bson.M{"field": bson.ObjectIdHex("ffffffffffffffffffffffff")},
+		expected:       hashMD5("ffffffffffffffffffffffff"),
+	},
+	{
+		name:           "base64",
+		templateString: `{{base64Encode .field}}:{{.field | base64Encode | base64Decode}}`,
+		payload:        bson.M{"field": "value"},
+		expected:       "dmFsdWU=:value",
+	},
+	{
+		name:           "urlEncode",
+		templateString: `{{urlEncode .field}}:{{.field | urlEncode | urlDecode}}`,
+		payload:        bson.M{"field": "a b&c"},
+		expected:       "a+b%26c:a b&c",
+	},
+	{
+		name:           "normalizeEmail",
+		templateString: `{{normalizeEmail .field}}`,
+		payload:        bson.M{"field": " CoolDude25@Example.com "},
+		expected:       "cooldude25@example.com",
+	},
+	{
+		name:           "normalizeEmail invalid",
+		templateString: `{{normalizeEmail .field}}`,
+		payload:        bson.M{"field": "not an email"},
+		expected:       "",
+	},
+	{
+		name:           "toString uuid",
+		templateString: `{{toString .field}}`,
+		payload:        bson.M{"field": testUUID},
+		expected:       "12345678-9abc-def0-1234-56789abcdef0",
+	},
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	for _, testCase := range templateFuncTests {
+		actual, err := ApplyTemplate(testCase.templateString, testCase.payload)
+		if !testCase.expectedError {
+			assert.Nil(t, err, "failed template func test: %s", testCase.name)
+			assert.Equal(t, testCase.expected, actual, "failed template func test: %s", testCase.name)
+		} else {
+			assert.Error(t, err, "wanted error, but returned %s", actual)
+		}
+	}
+}
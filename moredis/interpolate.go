@@ -0,0 +1,103 @@
+package moredis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolation matches ${ENV_VAR} and ${file:/path} references, and $${ escapes.
+var interpolation = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// Interpolate replaces ${ENV_VAR} in str with the value of the environment variable, and
+// ${file:/path} with the contents of the file, as read by ReadSecretFile.  $${ is replaced
+// with a literal ${.  It is an error to refer to an unset variable or unreadable file.
+func Interpolate(str string) (string, error) {
+	var firstErr error
+	interpolated := interpolation.ReplaceAllStringFunc(str, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		val, err := resolveReference(match[2 : len(match)-1])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return val
+	})
+	return interpolated, firstErr
+}
+
+func resolveReference(ref string) (string, error) {
+	if strings.HasPrefix(ref, "file:") {
+		return ReadSecretFile(strings.TrimPrefix(ref, "file:"))
+	}
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return val, nil
+}
+
+// ReadSecretFile reads a secret, such as a password or connection URL, from a file.
+// Surrounding whitespace, such as a trailing newline, is removed.
+func ReadSecretFile(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// interpolateNode interpolates every scalar in a YAML node tree, calling onError with the
+// node and error for each scalar that can't be interpolated.
+func interpolateNode(node *yaml.Node, onError func(*yaml.Node, error)) {
+	if node.Kind != yaml.ScalarNode {
+		for _, child := range node.Content {
+			interpolateNode(child, onError)
+		}
+		return
+	}
+	val, err := Interpolate(node.Value)
+	if err != nil {
+		onError(node, err)
+		return
+	}
+	if val != node.Value && node.Style == 0 {
+		// the type of plain scalars was resolved from the uninterpolated value, so clear it
+		// to have it resolved from the new value, e.g. stream_maxlen: ${MAXLEN}
+		node.Tag = ""
+	}
+	node.Value = val
+}
+
+// redactURL replaces any password in a connection URL, so that it can be logged.
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.User != nil && strings.Count(raw, "@") == 1 {
+		if _, ok := u.User.Password(); !ok {
+			return raw
+		}
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		return u.String()
+	}
+	// net/url can't parse mongo URLs with several hosts or URLs without a scheme, and
+	// misreads passwords with an unescaped @ or /, so redact everything between the
+	// username and the last @
+	prefix, rest := "", raw
+	if ix := strings.Index(raw, "://"); ix >= 0 {
+		prefix, rest = raw[:ix+3], raw[ix+3:]
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return raw
+	}
+	colon := strings.Index(rest[:at], ":")
+	if colon < 0 {
+		return raw
+	}
+	return prefix + rest[:colon+1] + "REDACTED" + rest[at:]
+}
@@ -0,0 +1,172 @@
+package moredis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// JSONValueConfig configures a map whose values are JSON objects built from each document,
+// as an alternative to a val template.
+type JSONValueConfig struct {
+	// Fields are the dotted paths of the fields to include.  If empty, the whole
+	// document is included.
+	Fields []string `yaml:"fields"`
+	// Rename maps a field (as listed in Fields, or a top level field if Fields is empty)
+	// to the name it is given in the JSON.  Renamed fields are always top level.
+	Rename map[string]string `yaml:"rename"`
+	// OmitNull leaves out fields that are null or missing.
+	OmitNull bool `yaml:"omit_null"`
+	// Flatten replaces nested documents with dotted keys, e.g. {"address.city": "..."}
+	Flatten bool `yaml:"flatten"`
+}
+
+// Render serializes a document as a JSON object according to the config.  Keys are always
+// sorted, so the same document always gives the same JSON.
+func (c JSONValueConfig) Render(doc bson.M) (string, error) {
+	out := map[string]interface{}{}
+	if len(c.Fields) == 0 {
+		for key, val := range doc {
+			out[c.name(key)] = jsonValue(val)
+		}
+	} else {
+		for _, field := range c.Fields {
+			val := jsonValue(getPath(doc, field))
+			if name, ok := c.Rename[field]; ok {
+				out[name] = val
+			} else {
+				setPath(out, field, val)
+			}
+		}
+	}
+	if c.Flatten {
+		out = flatten(out)
+	}
+	if c.OmitNull {
+		omitNulls(out)
+	}
+	marshalled, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	return string(marshalled), nil
+}
+
+func (c JSONValueConfig) name(field string) string {
+	if name, ok := c.Rename[field]; ok {
+		return name
+	}
+	return field
+}
+
+// jsonValue converts a value from a bson document into a value that encoding/json will
+// marshal sensibly.  ObjectIds become hex strings, dates become RFC3339 strings in UTC,
+// Decimal128s become strings (to keep their precision) and binary UUIDs become strings in
+// canonical form.  Other binary data becomes base64.
+func jsonValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case bson.M:
+		return jsonObject(val)
+	case map[string]interface{}:
+		return jsonObject(val)
+	case bson.D:
+		return jsonObject(val.Map())
+	case []interface{}:
+		arr := make([]interface{}, len(val))
+		for ix, elem := range val {
+			arr[ix] = jsonValue(elem)
+		}
+		return arr
+	case bson.ObjectId:
+		return val.Hex()
+	case time.Time:
+		return val.UTC().Format(time.RFC3339Nano)
+	case bson.Decimal128:
+		return val.String()
+	case bson.Binary:
+		if uuid, ok := formatUUID(val); ok {
+			return uuid
+		}
+		return base64.StdEncoding.EncodeToString(val.Data)
+	case float64:
+		// JSON has no representation for these
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil
+		}
+		return val
+	default:
+		return val
+	}
+}
+
+func jsonObject(doc map[string]interface{}) map[string]interface{} {
+	obj := make(map[string]interface{}, len(doc))
+	for key, val := range doc {
+		obj[key] = jsonValue(val)
+	}
+	return obj
+}
+
+// getPath returns the value at a dotted path in a document, or nil if there isn't one.
+// Unlike lookupPath, arrays are not traversed.
+func getPath(doc interface{}, path string) interface{} {
+	val := doc
+	for _, part := range strings.Split(path, ".") {
+		switch doc := val.(type) {
+		case bson.M:
+			val = doc[part]
+		case map[string]interface{}:
+			val = doc[part]
+		default:
+			return nil
+		}
+	}
+	return val
+}
+
+// setPath sets the value at a dotted path in obj, creating nested objects as needed.
+func setPath(obj map[string]interface{}, path string, val interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			obj[part] = next
+		}
+		obj = next
+	}
+	obj[parts[len(parts)-1]] = val
+}
+
+// flatten replaces nested objects with dotted keys.
+func flatten(obj map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	var add func(prefix string, obj map[string]interface{})
+	add = func(prefix string, obj map[string]interface{}) {
+		for key, val := range obj {
+			if nested, ok := val.(map[string]interface{}); ok && len(nested) > 0 {
+				add(prefix+key+".", nested)
+			} else {
+				flat[prefix+key] = val
+			}
+		}
+	}
+	add("", obj)
+	return flat
+}
+
+// omitNulls removes null values from obj and any objects nested in it.
+func omitNulls(obj map[string]interface{}) {
+	for key, val := range obj {
+		switch val := val.(type) {
+		case nil:
+			delete(obj, key)
+		case map[string]interface{}:
+			omitNulls(val)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var jsonTestDoc = bson.M{
+	"_id":     bson.ObjectIdHex("ffffffffffffffffffffffff"),
+	"name":    "Cool Dude",
+	"created": time.Date(2016, 3, 4, 5, 6, 7, 0, time.UTC),
+	"balance": mustDecimal("10.50"),
+	"uuid":    testUUID,
+	"nick":    nil,
+	"address": bson.M{"city": "Oakland", "zip": "94612"},
+	"tags":    []interface{}{"a", bson.M{"b": bson.ObjectIdHex("111111111111111111111111")}},
+}
+
+type jsonValueTestSpec struct {
+	name     string
+	config   JSONValueConfig
+	expected string
+}
+
+var jsonValueTests = []jsonValueTestSpec{
+	{
+		name:   "whole document",
+		config: JSONValueConfig{},
+		expected: `{"_id":"ffffffffffffffffffffffff","address":{"city":"Oakland","zip":"94612"},` +
+			`"balance":"10.50","created":"2016-03-04T05:06:07Z","name":"Cool Dude","nick":null,` +
+			`"tags":["a",{"b":"111111111111111111111111"}],"uuid":"12345678-9abc-def0-1234-56789abcdef0"}`,
+	},
+	{
+		name:     "selected fields",
+		config:   JSONValueConfig{Fields: []string{"name", "address.city", "missing"}},
+		expected: `{"address":{"city":"Oakland"},"missing":null,"name":"Cool Dude"}`,
+	},
+	{
+		name: "renamed fields",
+		config: JSONValueConfig{
+			Fields: []string{"_id", "address.city"},
+			Rename: map[string]string{"_id": "id", "address.city": "city"},
+		},
+		expected: `{"city":"Oakland","id":"ffffffffffffffffffffffff"}`,
+	},
+	{
+		name:     "omit nulls",
+		config:   JSONValueConfig{Fields: []string{"name", "nick", "missing"}, OmitNull: true},
+		expected: `{"name":"Cool Dude"}`,
+	},
+	{
+		name:     "flatten",
+		config:   JSONValueConfig{Fields: []string{"name", "address"}, Flatten: true},
+		expected: `{"address.city":"Oakland","address.zip":"94612","name":"Cool Dude"}`,
+	},
+}
+
+func TestJSONValueRender(t *testing.T) {
+	for _, testCase := range jsonValueTests {
+		actual, err := testCase.config.Render(jsonTestDoc)
+		assert.Nil(t, err, "failed json value test: %s", testCase.name)
+		assert.Equal(t, testCase.expected, actual, "failed json value test: %s", testCase.name)
+	}
+}
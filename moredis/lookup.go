@@ -0,0 +1,272 @@
+package moredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// lookupBatchSize is how many documents are read before the lookups for all of them are
+// fetched together.
+const lookupBatchSize = 500
+
+// lookupCacheSize is the most looked up values cached for each lookup during a build.  The
+// cache is emptied when it fills up.
+const lookupCacheSize = 100000
+
+// LookupConfig joins a document from another collection, or an entry from a map, onto each
+// document of a collection.  The value of LocalField in each document is looked up, and
+// the result is set as the field As, so templates can use e.g. {{.school.name}}.  If
+// LocalField is an array, As is an array of the results.  Documents with nothing to join
+// are left without As.
+type LookupConfig struct {
+	As         string `yaml:"as"`
+	LocalField string `yaml:"local_field"`
+	// Collection is the collection to look up documents in, by their ForeignField, which
+	// defaults to _id.  Projection optionally limits the fields of the looked up documents.
+	Collection   string `yaml:"collection"`
+	ForeignField string `yaml:"foreign_field"`
+	Projection   string `yaml:"projection"`
+	// Map is the name of a map to look up entries in, in place of Collection.  It is a
+	// template rendered with the params.  If the map is built by another collection of the
+	// same cache, that collection is built first.
+	Map string `yaml:"map"`
+}
+
+// foreignField returns the field that documents are looked up by.
+func (l LookupConfig) foreignField() string {
+	if l.ForeignField == "" {
+		return "_id"
+	}
+	return l.ForeignField
+}
+
+// projectForeignField changes a lookup's projection so that it returns the foreign field,
+// which documents are matched up with their keys by.  Exclusions of the field, or of a
+// field containing it, are dropped, since adding the field to an exclusion projection
+// would mix inclusion and exclusion.
+func projectForeignField(projection map[string]interface{}, foreign string) {
+	if len(projectionOmits(projection, []string{foreign})) == 0 {
+		return
+	}
+	for key, val := range projection {
+		if !isIncluded(val) && (key == foreign || isSubPath(foreign, key)) {
+			delete(projection, key)
+		}
+	}
+	if len(projectionOmits(projection, []string{foreign})) > 0 {
+		projection[foreign] = 1
+	}
+}
+
+// lookupFetcher fetches the values that match keys for a lookup.  The result is keyed by
+// the lookupCacheKey of each key that matched.
+type lookupFetcher func(ctx context.Context, lookup LookupConfig, keys []interface{}) (map[string]interface{}, error)
+
+// lookupCacheKey returns the key under which looked up values are cached.  Numbers are
+// normalized, since the same number is often stored with different types in different
+// collections.
+func lookupCacheKey(key interface{}) string {
+	if num, ok := asNumber(key); ok {
+		return fmt.Sprintf("number:%v", num)
+	}
+	return fmt.Sprintf("%T:%s", key, toString(key))
+}
+
+// joiner sets the results of a collection's lookups on batches of documents.
+type joiner struct {
+	lookups []LookupConfig
+	fetch   lookupFetcher
+	// caches hold the looked up values for each lookup, with nil for keys that matched
+	// nothing
+	caches []map[string]interface{}
+}
+
+func newJoiner(lookups []LookupConfig, fetch lookupFetcher) *joiner {
+	caches := make([]map[string]interface{}, len(lookups))
+	for ix := range caches {
+		caches[ix] = map[string]interface{}{}
+	}
+	return &joiner{lookups: lookups, fetch: fetch, caches: caches}
+}
+
+// join fetches the values looked up by docs that aren't already cached, with one fetch per
+// lookup, and sets them on docs.
+func (j *joiner) join(ctx context.Context, docs []bson.M) error {
+	for ix, lookup := range j.lookups {
+		local := strings.Split(lookup.LocalField, ".")
+		values := map[string]interface{}{}
+		missing := []interface{}{}
+		for _, doc := range docs {
+			for _, key := range lookupKeys(pathValue(doc, local)) {
+				cacheKey := lookupCacheKey(key)
+				if _, ok := values[cacheKey]; ok {
+					continue
+				}
+				val, ok := j.caches[ix][cacheKey]
+				values[cacheKey] = val
+				if !ok {
+					missing = append(missing, key)
+				}
+			}
+		}
+
+		if len(missing) > 0 {
+			found, err := j.fetch(ctx, lookup, missing)
+			if err != nil {
+				return fmt.Errorf("lookup %s: %s", lookup.As, err)
+			}
+			if len(j.caches[ix])+len(missing) > lookupCacheSize {
+				j.caches[ix] = map[string]interface{}{}
+			}
+			for _, key := range missing {
+				cacheKey := lookupCacheKey(key)
+				values[cacheKey] = found[cacheKey]
+				j.caches[ix][cacheKey] = found[cacheKey]
+			}
+		}
+
+		for _, doc := range docs {
+			key := pathValue(doc, local)
+			if items, ok := key.([]interface{}); ok {
+				joined := []interface{}{}
+				for _, item := range items {
+					if val := values[lookupCacheKey(item)]; val != nil {
+						joined = append(joined, val)
+					}
+				}
+				doc[lookup.As] = joined
+			} else if val := values[lookupCacheKey(key)]; key != nil && val != nil {
+				doc[lookup.As] = val
+			}
+		}
+	}
+	return nil
+}
+
+// lookupKeys returns the keys to look up for the value of a document's local field.
+func lookupKeys(val interface{}) []interface{} {
+	switch val := val.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		keys := []interface{}{}
+		for _, item := range val {
+			if item != nil {
+				keys = append(keys, item)
+			}
+		}
+		return keys
+	default:
+		return []interface{}{val}
+	}
+}
+
+// readMaps returns the names of the maps a collection reads, with lookups or by deriving
+// from them, as templates.
+func readMaps(collection CollectionConfig) []string {
+	names := []string{}
+	for _, lookup := range collection.Lookups {
+		if lookup.Map != "" {
+			names = append(names, lookup.Map)
+		}
+	}
+	if collection.Derive != nil {
+		names = append(names, collection.Derive.From)
+		for _, step := range collection.Derive.Steps {
+			if step.Compose != "" {
+				names = append(names, step.Compose)
+			}
+		}
+	}
+	return names
+}
+
+// mapDependencies returns, for each collection, the indexes of the other collections that
+// build the maps it reads.  Entity maps can't be read, since they aren't stored in a hash.
+func mapDependencies(collections []CollectionConfig, params Params) ([][]int, error) {
+	builtBy := map[string]int{}
+	entities := map[string]bool{}
+	for cix, collection := range collections {
+		for _, rmap := range collection.Maps {
+			name, err := ApplyTemplate(rmap.Name, params.Bson())
+			if err != nil {
+				return nil, err
+			}
+			builtBy[name] = cix
+			entities[name] = len(rmap.Fields) > 0
+		}
+	}
+	deps := make([][]int, len(collections))
+	for cix, collection := range collections {
+		for _, mapName := range readMaps(collection) {
+			name, err := ApplyTemplate(mapName, params.Bson())
+			if err != nil {
+				return nil, err
+			}
+			dep, ok := builtBy[name]
+			if !ok {
+				continue
+			}
+			if dep == cix {
+				return nil, fmt.Errorf("collection %s reads map %s, which it builds itself", collectionName(collection), name)
+			}
+			if entities[name] {
+				return nil, fmt.Errorf("collection %s reads map %s, which is an entity map", collectionName(collection), name)
+			}
+			deps[cix] = append(deps[cix], dep)
+		}
+	}
+	return deps, nil
+}
+
+// collectionName names a collection in messages.
+func collectionName(collection CollectionConfig) string {
+	if collection.Derive != nil && collection.Collection == "" {
+		return "derived from " + collection.Derive.From
+	}
+	return collection.Collection
+}
+
+// orderCollections orders collections so that each comes after the collections that build
+// the maps it reads, and otherwise keeps them in config order.  It returns the indexes of
+// the collections in build order, along with their dependencies as returned by
+// mapDependencies.
+func orderCollections(collections []CollectionConfig, params Params) ([]int, [][]int, error) {
+	deps, err := mapDependencies(collections, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	order := []int{}
+	placed := make([]bool, len(collections))
+	for len(order) < len(collections) {
+		progress := false
+		for cix := range collections {
+			if placed[cix] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps[cix] {
+				ready = ready && placed[dep]
+			}
+			if ready {
+				placed[cix] = true
+				order = append(order, cix)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			cycle := []string{}
+			for cix, collection := range collections {
+				if !placed[cix] {
+					cycle = append(cycle, collectionName(collection))
+				}
+			}
+			return nil, nil, fmt.Errorf("collections %s read each other's maps in a cycle", strings.Join(cycle, ", "))
+		}
+	}
+	return order, deps, nil
+}
@@ -0,0 +1,148 @@
+package moredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLookupCacheKey(t *testing.T) {
+	assert.Equal(t, lookupCacheKey(int32(1)), lookupCacheKey(float64(1)))
+	assert.NotEqual(t, lookupCacheKey("1"), lookupCacheKey(1))
+	id := bson.ObjectIdHex("5643ad1f7b3e5a0001000001")
+	assert.NotEqual(t, lookupCacheKey(id), lookupCacheKey(id.Hex()))
+}
+
+func TestProjectForeignField(t *testing.T) {
+	for _, spec := range []struct {
+		projection map[string]interface{}
+		foreign    string
+		expected   map[string]interface{}
+	}{
+		{map[string]interface{}{}, "_id", map[string]interface{}{}},
+		{map[string]interface{}{"name": 1}, "_id", map[string]interface{}{"name": 1}},
+		{map[string]interface{}{"name": 1, "_id": 0}, "_id", map[string]interface{}{"name": 1}},
+		{map[string]interface{}{"name": 1}, "a.b", map[string]interface{}{"name": 1, "a.b": 1}},
+		{map[string]interface{}{"a.b": 0, "c": 0}, "a.b", map[string]interface{}{"c": 0}},
+		// excluding a field containing the foreign field would hide it too
+		{map[string]interface{}{"a": 0, "c": 0}, "a.b", map[string]interface{}{"c": 0}},
+		{map[string]interface{}{"a.c": 0}, "a.b", map[string]interface{}{"a.c": 0}},
+	} {
+		projectForeignField(spec.projection, spec.foreign)
+		assert.Equal(t, spec.expected, spec.projection, spec.foreign)
+	}
+}
+
+func TestJoinerJoin(t *testing.T) {
+	schools := map[string]interface{}{
+		lookupCacheKey(1): bson.M{"_id": 1, "name": "hogwarts"},
+		lookupCacheKey(2): bson.M{"_id": 2, "name": "beauxbatons"},
+	}
+	var fetched [][]interface{}
+	fetch := func(ctx context.Context, lookup LookupConfig, keys []interface{}) (map[string]interface{}, error) {
+		fetched = append(fetched, keys)
+		return schools, nil
+	}
+	j := newJoiner([]LookupConfig{{As: "school", LocalField: "school.id", Collection: "schools"}}, fetch)
+
+	docs := []bson.M{
+		{"school": bson.M{"id": 1}},
+		{"school": bson.M{"id": int64(1)}},
+		{"school": bson.M{"id": []interface{}{2, 3}}},
+		{"school": bson.M{"id": 3}},
+		{},
+	}
+	assert.NoError(t, j.join(context.Background(), docs))
+	assert.Equal(t, [][]interface{}{{1, 2, 3}}, fetched)
+	assert.Equal(t, bson.M{"_id": 1, "name": "hogwarts"}, docs[0]["school"])
+	assert.Equal(t, bson.M{"_id": 1, "name": "hogwarts"}, docs[1]["school"])
+	assert.Equal(t, []interface{}{bson.M{"_id": 2, "name": "beauxbatons"}}, docs[2]["school"])
+	assert.Equal(t, bson.M{"id": 3}, docs[3]["school"])
+	assert.NotContains(t, docs[4], "school")
+
+	// keys that were fetched before, whether or not they matched, come from the cache
+	more := []bson.M{{"school": bson.M{"id": 3}}, {"school": bson.M{"id": 2}}}
+	assert.NoError(t, j.join(context.Background(), more))
+	assert.Len(t, fetched, 1)
+	assert.Equal(t, bson.M{"_id": 2, "name": "beauxbatons"}, more[1]["school"])
+}
+
+func TestOrderCollections(t *testing.T) {
+	collections := []CollectionConfig{
+		{Collection: "users", Lookups: []LookupConfig{{As: "school", Map: "schools:{{.env}}"}},
+			Maps: []MapConfig{{Name: "users"}}},
+		{Collection: "districts", Maps: []MapConfig{{Name: "districts"}}},
+		{Collection: "schools", Lookups: []LookupConfig{{As: "district", Map: "districts"}},
+			Maps: []MapConfig{{Name: "schools:{{.env}}"}}},
+	}
+	order, deps, err := orderCollections(collections, Params{"env": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 0}, order)
+	assert.Equal(t, [][]int{{2}, nil, {1}}, deps)
+
+	// lookups of maps that aren't built by the cache don't order anything
+	order, _, err = orderCollections(collections[:1], Params{"env": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, order)
+
+	collections[1].Lookups = []LookupConfig{{As: "user", Map: "users"}}
+	_, _, err = orderCollections(collections, Params{"env": "prod"})
+	assert.EqualError(t, err, "collections users, districts, schools read each other's maps in a cycle")
+
+	_, _, err = orderCollections([]CollectionConfig{
+		{Collection: "users", Lookups: []LookupConfig{{As: "u", Map: "users"}}, Maps: []MapConfig{{Name: "users"}}},
+	}, Params{})
+	assert.EqualError(t, err, "collection users reads map users, which it builds itself")
+
+	// entity maps aren't stored in a hash that can be looked up
+	_, _, err = orderCollections([]CollectionConfig{
+		{Collection: "users", Maps: []MapConfig{{Name: "user", Fields: map[string]string{"email": "{{.email}}"}}}},
+		{Collection: "schools", Lookups: []LookupConfig{{As: "u", Map: "user"}}, Maps: []MapConfig{{Name: "schools"}}},
+	}, Params{})
+	assert.EqualError(t, err, "collection schools reads map user, which is an entity map")
+}
+
+func TestBuilderLookups(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("INCR", "moredis:mapindexcounter").Expect(int64(1))
+	redigomock.Command("HSET", "moredis:maps:1", "a@x.com", "hogwarts").Expect(int64(1))
+	redigomock.Command("HSET", "moredis:maps:1", "b@x.com", "").Expect(int64(1))
+	redigomock.GenericCommand("HMSET").Expect("OK")
+	redigomock.Command("HLEN", "moredis:maps:1").Expect(int64(2))
+	redigomock.Command("GETSET", "users:school", "moredis:maps:1").ExpectError(redis.ErrNil)
+
+	var queries []map[string]interface{}
+	b := NewBuilder(nil, SingleConnPool(redigomock.NewConn()))
+	b.find = func(collection string, query, projection map[string]interface{}) MongoIter {
+		queries = append(queries, query)
+		if collection == "schools" {
+			assert.Equal(t, map[string]interface{}{"name": float64(1)}, projection)
+			return NewMockIter([]bson.M{{"_id": 1, "name": "hogwarts"}})
+		}
+		return NewMockIter([]bson.M{
+			{"email": "a@x.com", "school_id": 1},
+			{"email": "b@x.com", "school_id": 2},
+		})
+	}
+
+	config := Config{
+		Name: "test",
+		Collections: []CollectionConfig{{
+			Collection: "users",
+			Query:      "{}",
+			Lookups:    []LookupConfig{{As: "school", LocalField: "school_id", Collection: "schools", Projection: `{"name": 1}`}},
+			Maps: []MapConfig{
+				{Name: "users:school", Key: "{{.email}}", Value: "{{.school.name}}", Missing: MissingEmpty},
+			},
+		}},
+	}
+	report, err := b.Build(context.Background(), config, Params{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Collections[0].Maps[0].EntriesWritten)
+	assert.Len(t, queries, 2)
+	assert.Equal(t, map[string]interface{}{"_id": map[string]interface{}{"$in": []interface{}{1, 2}}}, queries[1])
+}
@@ -0,0 +1,79 @@
+package moredis
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache caches map entries in memory, evicting the least recently used entry once it
+// holds size entries.  Entries are keyed by the hash they were read from, so a map's
+// entries stop being used as soon as it is swapped to a new hash, and age out.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[lruKey]*list.Element
+	order   *list.List
+}
+
+type lruKey struct {
+	hashKey string
+	key     string
+}
+
+// lruEntry is a cached lookup.  found is false for keys the map has no entry for, and
+// expireAt is when redis expires the entry, or zero if it doesn't.
+type lruEntry struct {
+	lruKey
+	val      string
+	found    bool
+	expireAt time.Time
+}
+
+// expired reports whether redis has expired the entry by now.
+func (e lruEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// newLRUCache creates an lruCache holding up to size entries.  A size of zero or less
+// disables caching.
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: map[lruKey]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the cached lookup of key in hashKey, if there is one.
+func (c *lruCache) get(hashKey, key string) (lruEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[lruKey{hashKey, key}]
+	if !ok {
+		return lruEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(lruEntry), true
+}
+
+// add caches the lookup of key in hashKey, which expires at expireAt unless it's zero.
+func (c *lruCache) add(hashKey, key, val string, found bool, expireAt time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := lruEntry{lruKey{hashKey, key}, val, found, expireAt}
+	if elem, ok := c.entries[entry.lruKey]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.lruKey] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(lruEntry).lruKey)
+	}
+}
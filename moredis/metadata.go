@@ -0,0 +1,146 @@
+package moredis
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Version is the moredis version recorded in map metadata.  It is set at build time
+// from the VERSION file.
+var Version = "dev"
+
+// MapMetadata describes how a map was built.  It is stored in a redis hash alongside the
+// hash holding the map's data, so consumers can tell how fresh a map is.
+type MapMetadata struct {
+	HashKey    string    `json:"hash_key"`
+	BuildID    string    `json:"build_id"`
+	BuildStart time.Time `json:"build_start"`
+	BuildEnd   time.Time `json:"build_end"`
+	Documents  int       `json:"documents"`
+	Entries    int       `json:"entries"`
+	Version    string    `json:"version"`
+	Config     string    `json:"config"`
+	Params     Params    `json:"params"`
+	Query      string    `json:"query"`
+	Checksum   string    `json:"checksum"`
+	// Kind is MapKindEntity for entity maps, and empty for maps stored in a single hash.
+	Kind string `json:"kind,omitempty"`
+}
+
+// MetadataKey returns the key of the metadata hash for the map stored in hashKey.
+func MetadataKey(hashKey string) string {
+	return hashKey + ":meta"
+}
+
+// redisArgs returns the metadata as field/value pairs for HMSET.
+func (m MapMetadata) redisArgs() ([]interface{}, error) {
+	params, err := json.Marshal(m.Params)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{
+		"hash_key", m.HashKey,
+		"build_id", m.BuildID,
+		"build_start", m.BuildStart.UTC().Format(time.RFC3339Nano),
+		"build_end", m.BuildEnd.UTC().Format(time.RFC3339Nano),
+		"documents", m.Documents,
+		"entries", m.Entries,
+		"version", m.Version,
+		"config", m.Config,
+		"params", string(params),
+		"query", m.Query,
+		"checksum", m.Checksum,
+	}
+	if m.Kind != "" {
+		args = append(args, "kind", m.Kind)
+	}
+	return args, nil
+}
+
+// GetMapMetadata looks up the map currently referenced by mapName and returns its metadata.
+func GetMapMetadata(conn redis.Conn, mapName string) (MapMetadata, error) {
+	hashKey, err := redis.String(conn.Do("GET", mapName))
+	if err == redis.ErrNil {
+		return MapMetadata{}, fmt.Errorf("map %s does not exist", mapName)
+	}
+	if err != nil {
+		return MapMetadata{}, err
+	}
+	meta, ok, err := readMapMetadata(conn, hashKey)
+	if err != nil {
+		return MapMetadata{}, err
+	}
+	if !ok {
+		return MapMetadata{}, fmt.Errorf("map %s has no metadata", mapName)
+	}
+	return meta, nil
+}
+
+// readMapMetadata reads the metadata of the map stored in hashKey.  The bool result is
+// false if the map has no metadata.
+func readMapMetadata(conn redis.Conn, hashKey string) (MapMetadata, bool, error) {
+	fields, err := redis.StringMap(conn.Do("HGETALL", MetadataKey(hashKey)))
+	if err != nil {
+		return MapMetadata{}, false, err
+	}
+	if len(fields) == 0 {
+		return MapMetadata{}, false, nil
+	}
+
+	meta := MapMetadata{
+		HashKey:  hashKey,
+		BuildID:  fields["build_id"],
+		Version:  fields["version"],
+		Config:   fields["config"],
+		Query:    fields["query"],
+		Checksum: fields["checksum"],
+		Kind:     fields["kind"],
+	}
+	if meta.BuildStart, err = time.Parse(time.RFC3339Nano, fields["build_start"]); err != nil {
+		return MapMetadata{}, false, err
+	}
+	if meta.BuildEnd, err = time.Parse(time.RFC3339Nano, fields["build_end"]); err != nil {
+		return MapMetadata{}, false, err
+	}
+	if meta.Documents, err = strconv.Atoi(fields["documents"]); err != nil {
+		return MapMetadata{}, false, err
+	}
+	if meta.Entries, err = strconv.Atoi(fields["entries"]); err != nil {
+		return MapMetadata{}, false, err
+	}
+	if err := json.Unmarshal([]byte(fields["params"]), &meta.Params); err != nil {
+		return MapMetadata{}, false, err
+	}
+	return meta, true, nil
+}
+
+// entryChecksum is a checksum over the final entries of a map.  Each entry is hashed
+// separately and the hashes are summed, so the result doesn't depend on the order mongo
+// returns documents in.  The hash of each key's entry is kept, so that an entry that
+// overwrites one written earlier replaces it in the sum, as it does in redis.
+type entryChecksum struct {
+	sum     uint64
+	entries map[uint64]uint64
+}
+
+func (c *entryChecksum) add(key, val string) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	keyHash := h.Sum64()
+	h.Write([]byte{0})
+	h.Write([]byte(val))
+	if c.entries == nil {
+		c.entries = map[uint64]uint64{}
+	}
+	c.sum += h.Sum64() - c.entries[keyHash]
+	c.entries[keyHash] = h.Sum64()
+}
+
+func (c entryChecksum) String() string {
+	return fmt.Sprintf("%016x", c.sum)
+}
@@ -0,0 +1,81 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMapMetadata(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "map").Expect("map:1")
+	redigomock.Command("HGETALL", "map:1:meta").ExpectMap(map[string]string{
+		"hash_key":    "map:1",
+		"build_id":    "abc",
+		"build_start": "2016-01-01T00:00:00Z",
+		"build_end":   "2016-01-01T00:00:05Z",
+		"documents":   "2",
+		"entries":     "1",
+		"version":     "0.1.7",
+		"config":      "cache",
+		"params":      `{"id":"1"}`,
+		"query":       `{}`,
+		"checksum":    "0000000000000001",
+	})
+	meta, err := GetMapMetadata(redigomock.NewConn(), "map")
+	assert.Nil(t, err)
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, MapMetadata{
+		HashKey:    "map:1",
+		BuildID:    "abc",
+		BuildStart: start,
+		BuildEnd:   start.Add(5 * time.Second),
+		Documents:  2,
+		Entries:    1,
+		Version:    "0.1.7",
+		Config:     "cache",
+		Params:     Params{"id": "1"},
+		Query:      `{}`,
+		Checksum:   "0000000000000001",
+	}, meta)
+}
+
+func TestGetMapMetadataNoMap(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "map").ExpectError(redis.ErrNil)
+	_, err := GetMapMetadata(redigomock.NewConn(), "map")
+	assert.EqualError(t, err, "map map does not exist")
+}
+
+func TestEntryChecksumOrderIndependent(t *testing.T) {
+	var first, second entryChecksum
+	first.add("a", "1")
+	first.add("b", "2")
+	second.add("b", "2")
+	second.add("a", "1")
+	assert.Equal(t, first.String(), second.String())
+
+	var other entryChecksum
+	other.add("a", "2")
+	other.add("b", "1")
+	assert.NotEqual(t, first.String(), other.String())
+
+	// overwritten entries don't count, since redis only keeps the last one
+	other.add("a", "1")
+	other.add("b", "2")
+	assert.Equal(t, first.String(), other.String())
+}
+
+func TestMapMetadataKind(t *testing.T) {
+	// only entity maps record a kind
+	args, err := MapMetadata{}.redisArgs()
+	assert.NoError(t, err)
+	assert.NotContains(t, args, "kind")
+	args, err = MapMetadata{Kind: MapKindEntity}.redisArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"kind", MapKindEntity}, args[len(args)-2:])
+}
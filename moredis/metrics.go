@@ -0,0 +1,163 @@
+package moredis
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Registry holds all of the metrics collected while building caches.  It is exposed
+// over HTTP by MetricsHandler and can be sent to a pushgateway with PushMetrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	documentsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "documents_read_total",
+		Help:      "Number of documents read from mongo.",
+	}, []string{"cache", "collection"})
+
+	entriesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "entries_written_total",
+		Help:      "Number of entries written to redis hashes.",
+	}, []string{"cache", "map"})
+
+	keysSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "keys_skipped_total",
+		Help:      "Number of documents skipped because their key was empty or missing.",
+	}, []string{"cache", "map", "reason"})
+
+	templateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "template_errors_total",
+		Help:      "Number of errors executing key or val templates.",
+	}, []string{"cache", "map", "template"})
+
+	notifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "notify_failures_total",
+		Help:      "Number of swap notifications that could not be sent.",
+	}, []string{"cache", "map"})
+
+	flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "moredis",
+		Name:      "redis_flush_duration_seconds",
+		Help:      "Latency of flushing pipelined writes to redis.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"cache"})
+
+	buildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "moredis",
+		Name:      "build_duration_seconds",
+		Help:      "Time taken to build a cache.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"cache"})
+
+	lastSuccessfulBuild = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "moredis",
+		Name:      "last_successful_build_timestamp_seconds",
+		Help:      "Unix time of the last successful build of a cache.",
+	}, []string{"cache"})
+
+	serveRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "serve_requests_total",
+		Help:      "Number of HTTP requests handled by moredis serve.",
+	}, []string{"endpoint", "code"})
+
+	serveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "moredis",
+		Name:      "serve_request_duration_seconds",
+		Help:      "Latency of HTTP requests handled by moredis serve.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"endpoint"})
+
+	serveCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "moredis",
+		Name:      "serve_cache_lookups_total",
+		Help:      "Number of keys looked up in the moredis serve in-memory cache, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		documentsRead,
+		entriesWritten,
+		keysSkipped,
+		templateErrors,
+		notifyFailures,
+		flushDuration,
+		buildDuration,
+		lastSuccessfulBuild,
+		serveRequests,
+		serveDuration,
+		serveCacheLookups,
+	)
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics in Registry in the
+// prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// PushMetrics pushes the metrics in Registry to a pushgateway-compatible endpoint.
+// This is meant for one-shot runs, which exit before they can be scraped.
+func PushMetrics(pushURL, job, cache string) error {
+	return push.New(pushURL, job).Gatherer(Registry).Grouping("cache", cache).Push()
+}
+
+// MetricsSink records the metrics collected while building caches.  The default
+// MetricsSink records them in Registry.
+type MetricsSink interface {
+	// DocumentRead is called for each document read from a collection.
+	DocumentRead(cache, collection string)
+	// EntryWritten is called for each entry written to a map.
+	EntryWritten(cache, mapName string)
+	// KeySkipped is called for each entry a map doesn't write, with the reason why.
+	KeySkipped(cache, mapName, reason string)
+	// TemplateError is called when a map's key, val or when template fails.
+	TemplateError(cache, mapName, template string)
+	// NotifyFailed is called when the swap notification for a map can't be sent.
+	NotifyFailed(cache, mapName string)
+	// RedisFlushed is called with the time taken by each flush of pipelined writes.
+	RedisFlushed(cache string, duration time.Duration)
+	// BuildSucceeded is called with the time taken by each successful build.
+	BuildSucceeded(cache string, duration time.Duration)
+}
+
+type prometheusMetrics struct{}
+
+func (prometheusMetrics) DocumentRead(cache, collection string) {
+	documentsRead.WithLabelValues(cache, collection).Inc()
+}
+
+func (prometheusMetrics) EntryWritten(cache, mapName string) {
+	entriesWritten.WithLabelValues(cache, mapName).Inc()
+}
+
+func (prometheusMetrics) KeySkipped(cache, mapName, reason string) {
+	keysSkipped.WithLabelValues(cache, mapName, reason).Inc()
+}
+
+func (prometheusMetrics) TemplateError(cache, mapName, template string) {
+	templateErrors.WithLabelValues(cache, mapName, template).Inc()
+}
+
+func (prometheusMetrics) NotifyFailed(cache, mapName string) {
+	notifyFailures.WithLabelValues(cache, mapName).Inc()
+}
+
+func (prometheusMetrics) RedisFlushed(cache string, duration time.Duration) {
+	flushDuration.WithLabelValues(cache).Observe(duration.Seconds())
+}
+
+func (prometheusMetrics) BuildSucceeded(cache string, duration time.Duration) {
+	buildDuration.WithLabelValues(cache).Observe(duration.Seconds())
+	lastSuccessfulBuild.WithLabelValues(cache).SetToCurrentTime()
+}
@@ -1,13 +1,13 @@
 package moredis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/Clever/moredis/logger"
 	"github.com/garyburd/redigo/redis"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -37,129 +37,118 @@ func (p *Params) Bson() bson.M {
 	return ret
 }
 
-// BuildCache builds a redis cache according to the passed in config.
-func BuildCache(cacheConfig Config, params Params, redisURL string, mongoURL string) error {
-	logger.Info("Populating cache.", logger.M{"cache": cacheConfig.Name})
-
+// BuildCache builds a redis cache according to the passed in config, and returns a report
+// describing the build.  The report is returned even if the build fails, covering the work
+// done up to the failure.  It connects to mongo and redis for the build; use a Builder to
+// build with existing connections.
+func BuildCache(cacheConfig Config, params Params, redisURL string, mongoURL string) (BuildReport, error) {
 	// set up mongo/redis connections
 	mongoDb, redisConn, err := SetupDbs(mongoURL, redisURL)
 	if err != nil {
 		logger.Error("Failed to connect to dbs", err)
-		return err
+		report := BuildReport{Cache: cacheConfig.Name, Start: time.Now()}
+		report.finish(err)
+		return report, err
 	}
 	defer mongoDb.Session.Close()
 	defer redisConn.Close()
 
-	if err := processCollections(cacheConfig, params, mongoDb, redisConn); err != nil {
-		return err
-	}
-	return nil
+	return NewBuilder(mongoDb, SingleConnPool(redisConn)).Build(context.Background(), cacheConfig, params)
 }
 
-func processCollections(cacheConfig Config, params Params, mongoDb *mgo.Database, redisConn redis.Conn) error {
-	redisWriter := NewRedisWriter(redisConn)
-	for _, collection := range cacheConfig.Collections {
-		query, err := ParseTemplatedJSON(collection.Query, params)
-		if err != nil {
-			logger.Error("Failed to parse query", err)
-			return err
-		}
+// ProcessQuery iterates through all of the documents contained within iter, and maps
+// keys to values in a redis hash according to your mapping config.  It returns a report
+// of the documents scanned and the entries written to each map.
+func ProcessQuery(writer RedisWriter, iter MongoIter, maps []MapConfig) (CollectionReport, error) {
+	return processQuery(context.Background(), defaultBuildOptions(), writer, iter, "", CollectionConfig{Maps: maps}, nil)
+}
 
-		var iter MongoIter
-		var projection map[string]interface{}
-		if collection.Projection != "" {
-			var err error
-			projection, err = ParseTemplatedJSON(collection.Projection, params)
+// processQuery does the work of ProcessQuery, recording metrics labelled with the
+// cache and collection being processed.  It stops if ctx is cancelled.  If the collection
+// has lookups, documents are processed in batches, with fetch fetching the lookups for
+// each batch.
+func processQuery(ctx context.Context, opts buildOptions, writer RedisWriter, iter MongoIter, cache string,
+	collection CollectionConfig, fetch lookupFetcher) (CollectionReport, error) {
+	log := opts.logger
+	p := newQueryProcessor(opts, writer, cache, collection)
+	var j *joiner
+	if len(collection.Lookups) > 0 {
+		if fetch == nil {
+			iter.Close()
+			return p.finish(), fmt.Errorf("collection %s has lookups, which need a Builder", collection.Collection)
+		}
+		j = newJoiner(collection.Lookups, fetch)
+	}
+	batch := []bson.M{}
+	processBatch := func() error {
+		if j != nil && len(batch) > 0 {
+			joinStart := time.Now()
+			err := j.join(ctx, batch)
+			p.report.Timings.Query += time.Since(joinStart)
 			if err != nil {
-				logger.Error("Error applying projection template", err)
+				log.Error("Failed to fetch lookups", err)
+				return err
 			}
-			iter = mongoDb.C(collection.Collection).Find(query).Select(projection).Iter()
-		} else {
-			iter = mongoDb.C(collection.Collection).Find(query).Iter()
-		}
-
-		if err := SetRedisHashKeys(redisConn, &collection); err != nil {
-			logger.Error("Error setting up redis map keys", err)
-			return err
 		}
-
-		if err := ParseTemplates(&collection); err != nil {
-			logger.Error("Error parsing templates", err)
-			return err
-		}
-
-		logger.Info("Processing query for collection", logger.M{
-			"query":      query,
-			"collection": collection.Collection,
-			"projection": projection,
-		})
-		if err := ProcessQuery(redisWriter, iter, collection.Maps); err != nil {
-			logger.Error("Error processing query", err)
-			return err
-		}
-		if err := redisWriter.Flush(); err != nil {
-			logger.Error("Error flushing redis conn", err)
-			return err
-		}
-
-		for _, rmap := range collection.Maps {
-			if err := UpdateRedisMapReference(redisConn, params, rmap); err != nil {
-				logger.Error("Failed to update map reference", err)
+		for _, doc := range batch {
+			if err := p.processDocument(doc); err != nil {
 				return err
 			}
+			opts.metrics.DocumentRead(cache, collection.Collection)
+			p.report.DocumentsScanned++
 		}
+		batch = batch[:0]
+		return nil
 	}
-	logger.Info("Completed populating cache", logger.M{"cache": cacheConfig.Name})
-	return nil
-}
 
-// ProcessQuery iterates through all of the documents contained within iter, and maps
-// keys to values in a redis hash according to your mapping config.
-func ProcessQuery(writer RedisWriter, iter MongoIter, maps []MapConfig) error {
-	processed := 0
 	var result bson.M
-	var b bytes.Buffer
+	queryStart := time.Now()
 	for iter.Next(&result) {
-		for _, rmap := range maps {
-			if err := rmap.KeyTemplate.Execute(&b, result); err != nil {
-				logger.Error("Could not execute key template", err)
-				return err
-			}
-			key := b.String()
-			b.Reset()
-
-			if key == "" || key == "<no value>" {
-				continue
-			}
-
-			if err := rmap.ValueTemplate.Execute(&b, result); err != nil {
-				logger.Error("Could not execute value template", err)
-				return err
-			}
-			val := b.String()
-			b.Reset()
-
-			if err := writer.Send("HSET", rmap.HashKey, key, val); err != nil {
-				logger.Error("Could not send HSET", err)
-				return err
+		p.report.Timings.Query += time.Since(queryStart)
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return p.finish(), err
+		}
+		batch = append(batch, result)
+		if j == nil || len(batch) >= lookupBatchSize {
+			if err := processBatch(); err != nil {
+				iter.Close()
+				return p.finish(), err
 			}
 		}
-		processed++
+		if j != nil {
+			// the batch holds on to the document, so don't decode the next one into it
+			result = nil
+		}
+		queryStart = time.Now()
 	}
+	p.report.Timings.Query += time.Since(queryStart)
+	if err := processBatch(); err != nil {
+		iter.Close()
+		return p.finish(), err
+	}
+	if err := p.writeAggregates(); err != nil {
+		iter.Close()
+		return p.finish(), err
+	}
+	report := p.finish()
 	if err := iter.Err(); err != nil {
-		logger.Error("Iteration error", err)
-		return err
+		log.Error("Iteration error", err)
+		iter.Close()
+		return report, err
 	}
 	if err := iter.Close(); err != nil {
-		logger.Error("Iter.Close() error", err)
-		return err
+		log.Error("Iter.Close() error", err)
+		return report, err
 	}
+	writeStart := time.Now()
 	if err := writer.Flush(); err != nil {
-		logger.Error("Error flushing", err)
-		return err
+		log.Error("Error flushing", err)
+		return report, err
 	}
-	logger.Info("Processed all documents for query", logger.M{"processed": processed})
-	return nil
+	report.Timings.Write += time.Since(writeStart)
+	log.Info("Processed all documents for query", logger.M{"processed": report.DocumentsScanned})
+	return report, nil
 }
 
 // SetRedisHashKeys determines the correct keys to use for the redis hashes that
@@ -177,25 +166,57 @@ func SetRedisHashKeys(conn redis.Conn, collection *CollectionConfig) error {
 }
 
 // UpdateRedisMapReference updates the map specified in redis to point to the newly populated hashes,
-// then deletes the previously referenced hash.  The hash reference is updated atomically.
+// then deletes the previously referenced hash, and for entity maps its entities.
+// Maps with a ttl have it set on their name and hash.
+// The hash reference is updated atomically.
+// If the map config has metadata, it is written before the reference is updated so that
+// it is always available for the referenced hash.
 func UpdateRedisMapReference(conn redis.Conn, params Params, mapConfig MapConfig) error {
+	_, _, err := updateRedisMapReference(conn, kayveeLogger{}, params, mapConfig)
+	return err
+}
+
+// updateRedisMapReference does the work of UpdateRedisMapReference, returning the rendered
+// map name and the key of the previously referenced hash, which is empty if there was none.
+func updateRedisMapReference(conn redis.Conn, log Logger, params Params, mapConfig MapConfig) (string, string, error) {
 	mapName, err := ApplyTemplate(mapConfig.Name, params.Bson())
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	if mapConfig.Metadata != nil {
+		fields, err := mapConfig.Metadata.redisArgs()
+		if err != nil {
+			return "", "", err
+		}
+		args := append([]interface{}{MetadataKey(mapConfig.HashKey)}, fields...)
+		if _, err := conn.Do("HMSET", args...); err != nil {
+			return "", "", err
+		}
 	}
 	oldMap, err := redis.String(conn.Do("GETSET", mapName, mapConfig.HashKey))
-	logger.Info("Updating map reference", logger.M{"map": mapName, "oldref": oldMap, "newref": mapConfig.HashKey})
+	log.Info("Updating map reference", logger.M{"map": mapName, "oldref": oldMap, "newref": mapConfig.HashKey})
+	if err != nil && err != redis.ErrNil {
+		return "", "", err
+	}
+	// GETSET clears the name's ttl, so it is set again for every build
+	if expireErr := expireMap(conn, mapName, mapConfig); expireErr != nil {
+		return "", "", expireErr
+	}
 	if err == redis.ErrNil {
 		// no old map, just return
-		return nil
-	}
-	if err != nil {
-		return err
+		return mapName, "", nil
 	}
 
-	logger.Info("Deleting old referenced map", logger.M{"map": oldMap})
-	if _, err := conn.Do("DEL", oldMap); err != nil {
-		return err
+	log.Info("Deleting old referenced map", logger.M{"map": oldMap})
+	if _, err := conn.Do("DEL", oldMap, MetadataKey(oldMap)); err != nil {
+		return "", "", err
 	}
-	return nil
+	if len(mapConfig.Fields) > 0 {
+		// the map has been swapped, so entities left behind are logged rather than failing
+		// the build
+		if err := deleteEntities(conn, log, oldMap); err != nil {
+			log.Error("Failed to delete old entities", err)
+		}
+	}
+	return mapName, oldMap, nil
 }
@@ -1,11 +1,14 @@
 package moredis
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rafaeljusto/redigomock"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/mgo.v2/bson"
@@ -58,8 +61,11 @@ func TestProcessQuery(t *testing.T) {
 	writer := NewRedisWriter(redigomock.NewConn())
 	err := ParseTemplates(&collection)
 	assert.Nil(t, err)
-	err = ProcessQuery(writer, iter, collection.Maps)
+	report, err := ProcessQuery(writer, iter, collection.Maps)
 	assert.Nil(t, err)
+	assert.Equal(t, 1, report.DocumentsScanned)
+	assert.Equal(t, 1, report.Maps[0].EntriesWritten)
+	assert.Equal(t, "moredis:maps:1", report.Maps[0].NewHashKey)
 }
 
 func TestUpdateRedisMapReferenceNoOldMap(t *testing.T) {
@@ -81,7 +87,7 @@ func TestUpdateRedisMapReferenceWithOldMap(t *testing.T) {
 	// should work with a previous map
 	redigomock.Clear()
 	redigomock.Command("GETSET", "map", "map:2").Expect("map:1")
-	redigomock.Command("DEL", "map:1").Expect("ok")
+	redigomock.Command("DEL", "map:1", "map:1:meta").Expect("ok")
 	err := UpdateRedisMapReference(redigomock.NewConn(),
 		Params{},
 		MapConfig{
@@ -107,7 +113,7 @@ func TestUpdateRedisMapReferenceRedisErrors(t *testing.T) {
 
 	redigomock.Clear()
 	redigomock.Command("GETSET", "map", "map:1").Expect("map:0")
-	redigomock.Command("DEL", "map:0").ExpectError(errors.New("redis error"))
+	redigomock.Command("DEL", "map:0", "map:0:meta").ExpectError(errors.New("redis error"))
 	err = UpdateRedisMapReference(redigomock.NewConn(),
 		Params{},
 		MapConfig{
@@ -137,3 +143,77 @@ func TestSetRedisHashKeysRedisError(t *testing.T) {
 	err := SetRedisHashKeys(redigomock.NewConn(), &collectionConfig)
 	assert.EqualError(t, err, "redis error")
 }
+
+func TestProcessQueryMetrics(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"test": "1", "val": "expected"},
+		{"val": "missing key"},
+		{"test": "", "val": "empty key"},
+	})
+
+	collection := CollectionConfig{
+		Collection: "metrics",
+		Maps: []MapConfig{
+			{
+				Name:    "metrics:map",
+				Key:     "{{.test}}",
+				Value:   "{{.val}}",
+				HashKey: "moredis:maps:1",
+			},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "1", "expected").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := processQuery(context.Background(), defaultBuildOptions(), writer, iter, "metrics-cache", collection, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"empty": 1, "no_value": 1}, report.Maps[0].Skipped)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(documentsRead.WithLabelValues("metrics-cache", "metrics")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(entriesWritten.WithLabelValues("metrics-cache", "metrics:map")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(keysSkipped.WithLabelValues("metrics-cache", "metrics:map", "no_value")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(keysSkipped.WithLabelValues("metrics-cache", "metrics:map", "empty")))
+}
+
+func TestUpdateRedisMapReferenceWithMetadata(t *testing.T) {
+	// should write metadata before swapping the reference
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	redigomock.Clear()
+	redigomock.Command("HMSET", "map:2:meta",
+		"hash_key", "map:2",
+		"build_id", "abc",
+		"build_start", "2016-01-01T00:00:00Z",
+		"build_end", "2016-01-01T00:00:05Z",
+		"documents", 2,
+		"entries", 1,
+		"version", "dev",
+		"config", "cache",
+		"params", `{"id":"1"}`,
+		"query", `{"id":"1"}`,
+		"checksum", "0000000000000001",
+	).Expect("OK")
+	redigomock.Command("GETSET", "map", "map:2").Expect("map:1")
+	redigomock.Command("DEL", "map:1", "map:1:meta").Expect("ok")
+	err := UpdateRedisMapReference(redigomock.NewConn(),
+		Params{},
+		MapConfig{
+			Name:    "map",
+			HashKey: "map:2",
+			Metadata: &MapMetadata{
+				HashKey:    "map:2",
+				BuildID:    "abc",
+				BuildStart: start,
+				BuildEnd:   start.Add(5 * time.Second),
+				Documents:  2,
+				Entries:    1,
+				Version:    "dev",
+				Config:     "cache",
+				Params:     Params{"id": "1"},
+				Query:      `{"id":"1"}`,
+				Checksum:   "0000000000000001",
+			},
+		},
+	)
+	assert.Nil(t, err)
+}
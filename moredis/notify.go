@@ -0,0 +1,63 @@
+package moredis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// NotifyConfig configures the notifications sent when a map is swapped to a new hash.
+type NotifyConfig struct {
+	// Channel is the channel to PUBLISH swap messages on.
+	Channel string `yaml:"channel"`
+	// Stream is an optional redis stream to XADD swap messages to, for consumers
+	// that were not subscribed when the swap happened.
+	Stream string `yaml:"stream"`
+	// StreamMaxLen caps the approximate length of Stream.  Zero means no cap.
+	StreamMaxLen int `yaml:"stream_maxlen"`
+}
+
+// MapSwap is the message sent when a map is swapped to a new hash.
+type MapSwap struct {
+	Map        string `json:"map"`
+	OldHashKey string `json:"old_hash_key"`
+	NewHashKey string `json:"new_hash_key"`
+	BuildID    string `json:"build_id"`
+}
+
+// PublishMapSwap sends a swap message as JSON to the channel and stream in notify.
+// Nothing is sent for a notify config with no channel or stream.
+func PublishMapSwap(conn redis.Conn, notify NotifyConfig, swap MapSwap) error {
+	raw, err := json.Marshal(swap)
+	if err != nil {
+		return err
+	}
+	message := string(raw)
+	if notify.Channel != "" {
+		if _, err := conn.Do("PUBLISH", notify.Channel, message); err != nil {
+			return err
+		}
+	}
+	if notify.Stream != "" {
+		args := []interface{}{notify.Stream}
+		if notify.StreamMaxLen > 0 {
+			args = append(args, "MAXLEN", "~", notify.StreamMaxLen)
+		}
+		args = append(args, "*", "message", message)
+		if _, err := conn.Do("XADD", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newBuildID returns a random identifier for a build of a cache.
+func newBuildID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,38 @@
+package moredis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSwap = MapSwap{Map: "map", OldHashKey: "map:1", NewHashKey: "map:2", BuildID: "abc"}
+
+const testSwapMessage = `{"map":"map","old_hash_key":"map:1","new_hash_key":"map:2","build_id":"abc"}`
+
+func TestPublishMapSwapNoNotify(t *testing.T) {
+	// should send nothing without a channel or stream
+	redigomock.Clear()
+	err := PublishMapSwap(redigomock.NewConn(), NotifyConfig{}, testSwap)
+	assert.Nil(t, err)
+}
+
+func TestPublishMapSwapChannelAndStream(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("PUBLISH", "swaps", testSwapMessage).Expect(int64(1))
+	redigomock.Command("XADD", "swaps:stream", "MAXLEN", "~", 1000, "*", "message", testSwapMessage).Expect("1-0")
+	err := PublishMapSwap(redigomock.NewConn(),
+		NotifyConfig{Channel: "swaps", Stream: "swaps:stream", StreamMaxLen: 1000},
+		testSwap,
+	)
+	assert.Nil(t, err)
+}
+
+func TestPublishMapSwapRedisError(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("PUBLISH", "swaps", testSwapMessage).ExpectError(errors.New("redis error"))
+	err := PublishMapSwap(redigomock.NewConn(), NotifyConfig{Channel: "swaps"}, testSwap)
+	assert.EqualError(t, err, "redis error")
+}
@@ -0,0 +1,400 @@
+package moredis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Clever/moredis/logger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// queryProcessor holds the state of processQuery as it writes the entries for each document.
+type queryProcessor struct {
+	writer   RedisWriter
+	log      Logger
+	metrics  MetricsSink
+	cache    string
+	maps     []MapConfig
+	computed []ComputedField
+	// aggregates accumulate the entries of aggregate maps, and are nil for other maps
+	aggregates []*aggregator
+	report     CollectionReport
+	checksums  []entryChecksum
+	buf        bytes.Buffer
+}
+
+func newQueryProcessor(opts buildOptions, writer RedisWriter, cache string, collection CollectionConfig) *queryProcessor {
+	aggregates := make([]*aggregator, len(collection.Maps))
+	for ix, rmap := range collection.Maps {
+		if rmap.Aggregate != "" {
+			aggregates[ix] = newAggregator(rmap.Aggregate)
+		}
+	}
+	return &queryProcessor{
+		aggregates: aggregates,
+		writer:     writer,
+		log:        opts.logger,
+		metrics:    opts.metrics,
+		cache:      cache,
+		maps:       collection.Maps,
+		computed:   collection.Computed,
+		report:     newCollectionReport(collection),
+		checksums:  make([]entryChecksum, len(collection.Maps)),
+	}
+}
+
+// processDocument sets the computed fields of a document, then writes its entries to each
+// map.
+func (p *queryProcessor) processDocument(doc bson.M) error {
+	for _, field := range p.computed {
+		val, err := field.Expression.Eval(doc)
+		if err != nil {
+			err = fmt.Errorf("computed field %s: %s", field.Name, err)
+			p.metrics.TemplateError(p.cache, field.Name, "computed")
+			p.log.Error("Could not evaluate computed field", err)
+			return err
+		}
+		doc[field.Name] = val
+	}
+	for ix, rmap := range p.maps {
+		if rmap.WhenTemplate != nil {
+			matches, err := p.when(rmap, doc)
+			if err != nil {
+				p.metrics.TemplateError(p.cache, rmap.Name, "when")
+				p.log.Error("Could not execute when template", err)
+				p.report.Maps[ix].Error = err.Error()
+				return err
+			}
+			if !matches {
+				p.skip(ix, "when")
+				continue
+			}
+		}
+
+		if rmap.ForEach == "" {
+			if err := p.processEntry(ix, rmap, doc); err != nil {
+				return err
+			}
+			continue
+		}
+
+		items := lookupPath(doc, rmap.ForEach)
+		if len(items) == 0 {
+			p.skip(ix, "no_items")
+			continue
+		}
+		// bind each item to .item in turn, restoring any field of that name afterwards
+		prev, hadItem := doc["item"]
+		for _, item := range items {
+			doc["item"] = item
+			if err := p.processEntry(ix, rmap, doc); err != nil {
+				return err
+			}
+		}
+		if hadItem {
+			doc["item"] = prev
+		} else {
+			delete(doc, "item")
+		}
+	}
+	return nil
+}
+
+// when evaluates a map's when template against a document, reporting whether the
+// document should be included in the map.
+func (p *queryProcessor) when(rmap MapConfig, doc bson.M) (bool, error) {
+	renderStart := time.Now()
+	defer func() { p.report.Timings.Render += time.Since(renderStart) }()
+	defer p.buf.Reset()
+	if err := rmap.WhenTemplate.Execute(&p.buf, doc); err != nil {
+		return false, err
+	}
+	return isTruthy(p.buf.String()), nil
+}
+
+// isTruthy reports whether the output of a when template includes the document.
+func isTruthy(out string) bool {
+	switch strings.ToLower(strings.TrimSpace(out)) {
+	case "", "false", "0", noValue:
+		return false
+	default:
+		return true
+	}
+}
+
+// processEntry renders the key and val templates of a map against data and writes the
+// resulting entry.
+func (p *queryProcessor) processEntry(ix int, rmap MapConfig, data bson.M) error {
+	if rmap.TransformFunc != nil {
+		return p.processTransform(ix, rmap, data)
+	}
+	mapReport := &p.report.Maps[ix]
+	renderStart := time.Now()
+	key, keyMissing, err := p.execute(rmap, rmap.KeyTemplate, data)
+	if keyMissing {
+		mapReport.Missing++
+	}
+	if err != nil {
+		if keyMissing && rmap.Missing == MissingSkip {
+			p.report.Timings.Render += time.Since(renderStart)
+			p.skip(ix, "missing")
+			return nil
+		}
+		p.metrics.TemplateError(p.cache, rmap.Name, "key")
+		p.log.Error("Could not execute key template", err)
+		mapReport.Error = err.Error()
+		return err
+	}
+
+	if key == "" {
+		p.report.Timings.Render += time.Since(renderStart)
+		p.skip(ix, "empty")
+		return nil
+	}
+	if key == noValue {
+		p.report.Timings.Render += time.Since(renderStart)
+		p.skip(ix, "no_value")
+		return nil
+	}
+
+	if rmap.FieldTemplates != nil {
+		p.report.Timings.Render += time.Since(renderStart)
+		return p.processEntity(ix, rmap, key, keyMissing, data)
+	}
+
+	val, valMissing, err := p.renderValue(rmap, data)
+	if valMissing && !keyMissing {
+		mapReport.Missing++
+	}
+	if err != nil {
+		if valMissing && rmap.Missing == MissingSkip {
+			p.report.Timings.Render += time.Since(renderStart)
+			p.skip(ix, "missing")
+			return nil
+		}
+		p.metrics.TemplateError(p.cache, rmap.Name, "val")
+		p.log.Error("Could not execute value template", err)
+		mapReport.Error = err.Error()
+		return err
+	}
+	expireAt, expires, err := p.renderExpires(ix, rmap, data)
+	p.report.Timings.Render += time.Since(renderStart)
+	if err != nil {
+		return err
+	}
+	if expires && !expireAt.After(time.Now()) {
+		p.skip(ix, "expired")
+		return nil
+	}
+	if err := p.writeEntry(ix, rmap, key, val); err != nil {
+		return err
+	}
+	if expires {
+		return p.sendExpiry(ix, "HPEXPIREAT", rmap.HashKey, epochMillis(expireAt), "FIELDS", 1, key)
+	}
+	return nil
+}
+
+// processTransform writes the entries computed by a map's transform from data.
+func (p *queryProcessor) processTransform(ix int, rmap MapConfig, data bson.M) error {
+	renderStart := time.Now()
+	entries, err := rmap.TransformFunc(data)
+	p.report.Timings.Render += time.Since(renderStart)
+	if err != nil {
+		p.metrics.TemplateError(p.cache, rmap.Name, "transform")
+		p.log.Error("Could not execute transform", err)
+		p.report.Maps[ix].Error = err.Error()
+		return err
+	}
+	if len(entries) == 0 {
+		p.skip(ix, "no_entries")
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Key == "" {
+			p.skip(ix, "empty")
+			continue
+		}
+		if err := p.writeEntry(ix, rmap, entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes an entry to a map, or adds it to the map's aggregate.
+func (p *queryProcessor) writeEntry(ix int, rmap MapConfig, key, val string) error {
+	if agg := p.aggregates[ix]; agg != nil {
+		if !agg.add(key, val) {
+			p.skip(ix, "not_a_number")
+		}
+		return nil
+	}
+	return p.sendEntry(ix, rmap, key, val)
+}
+
+// writeAggregates writes the entries accumulated for the aggregate maps.
+func (p *queryProcessor) writeAggregates() error {
+	for ix, agg := range p.aggregates {
+		if agg == nil {
+			continue
+		}
+		for _, entry := range agg.entries() {
+			if err := p.sendEntry(ix, p.maps[ix], entry.Key, entry.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendEntry sends the HSET for an entry.
+func (p *queryProcessor) sendEntry(ix int, rmap MapConfig, key, val string) error {
+	mapReport := &p.report.Maps[ix]
+	writeStart := time.Now()
+	if err := p.writer.Send("HSET", rmap.HashKey, key, val); err != nil {
+		p.log.Error("Could not send HSET", err)
+		mapReport.Error = err.Error()
+		return err
+	}
+	p.report.Timings.Write += time.Since(writeStart)
+	p.metrics.EntryWritten(p.cache, rmap.Name)
+	mapReport.EntriesWritten++
+	p.checksums[ix].add(key, val)
+	return nil
+}
+
+// renderExpires renders the expires template of a map against data.  The second return
+// value is false if the entry doesn't expire.
+func (p *queryProcessor) renderExpires(ix int, rmap MapConfig, data bson.M) (time.Time, bool, error) {
+	if rmap.ExpiresTemplate == nil {
+		return time.Time{}, false, nil
+	}
+	defer p.buf.Reset()
+	err := rmap.ExpiresTemplate.Execute(&p.buf, data)
+	var expireAt time.Time
+	var expires bool
+	if err == nil {
+		expireAt, expires, err = expiryTime(p.buf.String(), time.Now())
+	}
+	if err != nil {
+		p.metrics.TemplateError(p.cache, rmap.Name, "expires")
+		p.log.Error("Could not execute expires template", err)
+		p.report.Maps[ix].Error = err.Error()
+		return time.Time{}, false, err
+	}
+	return expireAt, expires, nil
+}
+
+// sendExpiry sends a command setting when an entry expires.
+func (p *queryProcessor) sendExpiry(ix int, cmd string, args ...interface{}) error {
+	writeStart := time.Now()
+	if err := p.writer.Send(cmd, args...); err != nil {
+		p.log.Error("Could not send "+cmd, err)
+		p.report.Maps[ix].Error = err.Error()
+		return err
+	}
+	p.report.Timings.Write += time.Since(writeStart)
+	return nil
+}
+
+// renderValue renders the value of an entry, either as a JSON object or using the val
+// template.  The second return value reports whether the template used a missing field.
+func (p *queryProcessor) renderValue(rmap MapConfig, data bson.M) (string, bool, error) {
+	if rmap.ValueJSON != nil {
+		val, err := rmap.ValueJSON.Render(data)
+		return val, false, err
+	}
+	return p.execute(rmap, rmap.ValueTemplate, data)
+}
+
+// noValue is what text/template prints for fields missing from a document.
+const noValue = "<no value>"
+
+// execute executes one of a map's templates, handling missing fields according to the map's
+// missing mode.  The second return value reports whether the template used a missing field,
+// either printing it or passing it to a function.
+func (p *queryProcessor) execute(rmap MapConfig, tmpl *template.Template, data bson.M) (string, bool, error) {
+	defer p.buf.Reset()
+	if rmap.missingFields != nil {
+		rmap.missingFields.missing = false
+	}
+	if err := tmpl.Execute(&p.buf, data); err != nil {
+		return "", false, err
+	}
+	out := p.buf.String()
+	if !strings.Contains(out, noValue) && (rmap.missingFields == nil || !rmap.missingFields.missing) {
+		return out, false, nil
+	}
+	switch rmap.Missing {
+	case MissingError, MissingSkip:
+		return "", true, fmt.Errorf("%s template used a field missing from the document", templatePart(tmpl))
+	case MissingEmpty:
+		out = strings.Replace(out, noValue, "", -1)
+	case MissingDefault:
+		out = strings.Replace(out, noValue, rmap.MissingDefault, -1)
+	}
+	return out, true, nil
+}
+
+// templatePart returns which of a map's templates tmpl is, e.g. "key" or "fields.email",
+// from its name.
+func templatePart(tmpl *template.Template) string {
+	name := tmpl.Name()
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+// skip records that a map produced no entry, and why.
+func (p *queryProcessor) skip(ix int, reason string) {
+	p.metrics.KeySkipped(p.cache, p.maps[ix].Name, reason)
+	p.report.Maps[ix].Skipped[reason]++
+}
+
+// finish fills in the parts of the report that are computed at the end of processing.
+func (p *queryProcessor) finish() CollectionReport {
+	for ix := range p.report.Maps {
+		p.report.Maps[ix].Checksum = p.checksums[ix].String()
+		if missing := p.report.Maps[ix].Missing; missing > 0 {
+			p.log.Warning("Documents missing fields used by map", logger.M{
+				"map":     p.maps[ix].Name,
+				"missing": missing,
+				"mode":    p.maps[ix].Missing,
+			})
+		}
+	}
+	return p.report
+}
+
+// lookupPath returns the values at a dotted path (e.g. "contacts.email") in a document.
+// Arrays along the path are traversed, so each element of an array of documents
+// contributes its value, and an array at the end of the path is flattened into its
+// elements.  Missing and null values are left out.
+func lookupPath(doc interface{}, path string) []interface{} {
+	return appendPathValues(nil, doc, strings.Split(path, "."))
+}
+
+func appendPathValues(values []interface{}, val interface{}, path []string) []interface{} {
+	switch val := val.(type) {
+	case nil:
+		return values
+	case []interface{}:
+		for _, elem := range val {
+			values = appendPathValues(values, elem, path)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return append(values, val)
+	}
+	switch val := val.(type) {
+	case bson.M:
+		return appendPathValues(values, val[path[0]], path[1:])
+	case map[string]interface{}:
+		return appendPathValues(values, val[path[0]], path[1:])
+	default:
+		return values
+	}
+}
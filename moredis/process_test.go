@@ -0,0 +1,365 @@
+package moredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type lookupPathTestSpec struct {
+	name     string
+	doc      bson.M
+	path     string
+	expected []interface{}
+}
+
+var lookupPathTests = []lookupPathTestSpec{
+	{
+		name:     "array field",
+		doc:      bson.M{"emails": []interface{}{"a@x", "b@x"}},
+		path:     "emails",
+		expected: []interface{}{"a@x", "b@x"},
+	},
+	{
+		name:     "scalar field",
+		doc:      bson.M{"email": "a@x"},
+		path:     "email",
+		expected: []interface{}{"a@x"},
+	},
+	{
+		name: "field of array of documents",
+		doc: bson.M{"contacts": []interface{}{
+			bson.M{"email": "a@x"},
+			bson.M{"phone": "555"},
+			bson.M{"email": "b@x"},
+		}},
+		path:     "contacts.email",
+		expected: []interface{}{"a@x", "b@x"},
+	},
+	{
+		name:     "nested document",
+		doc:      bson.M{"profile": bson.M{"emails": []interface{}{"a@x"}}},
+		path:     "profile.emails",
+		expected: []interface{}{"a@x"},
+	},
+	{
+		name:     "missing field",
+		doc:      bson.M{},
+		path:     "emails",
+		expected: nil,
+	},
+	{
+		name:     "path through scalar",
+		doc:      bson.M{"contacts": "none"},
+		path:     "contacts.email",
+		expected: nil,
+	},
+}
+
+func TestLookupPath(t *testing.T) {
+	for _, testCase := range lookupPathTests {
+		actual := lookupPath(testCase.doc, testCase.path)
+		assert.Equal(t, testCase.expected, actual, "failed lookupPath test: %s", testCase.name)
+	}
+}
+
+func TestProcessQueryForEach(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "emails": []interface{}{"A@x", "b@x"}, "item": "kept"},
+		{"_id": "2"},
+	})
+
+	collection := CollectionConfig{
+		Maps: []MapConfig{
+			{
+				Key:     "{{toLower .item}}",
+				Value:   "{{._id}}",
+				ForEach: "emails",
+				HashKey: "moredis:maps:1",
+			},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "a@x", "1").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:1", "b@x", "1").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.DocumentsScanned)
+	assert.Equal(t, 2, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"no_items": 1}, report.Maps[0].Skipped)
+	// the document's own item field is restored
+	assert.Equal(t, "kept", iter.Records[0]["item"])
+}
+
+type missingModeTestSpec struct {
+	name          string
+	missing       string
+	expectedHSETs [][]interface{}
+	expectedError bool
+	skipped       map[string]int
+}
+
+var missingModeTests = []missingModeTestSpec{
+	{
+		name:          "unset writes <no value>",
+		missing:       "",
+		expectedHSETs: [][]interface{}{{"1", "val:<no value>"}, {"2", "val:two"}},
+		skipped:       map[string]int{"no_value": 1},
+	},
+	{
+		name:          "error",
+		missing:       MissingError,
+		expectedError: true,
+		skipped:       map[string]int{},
+	},
+	{
+		name:          "skip",
+		missing:       MissingSkip,
+		expectedHSETs: [][]interface{}{{"2", "val:two"}},
+		skipped:       map[string]int{"missing": 2},
+	},
+	{
+		name:          "empty",
+		missing:       MissingEmpty,
+		expectedHSETs: [][]interface{}{{"1", "val:"}, {"2", "val:two"}},
+		skipped:       map[string]int{"empty": 1},
+	},
+	{
+		name:          "default",
+		missing:       MissingDefault,
+		expectedHSETs: [][]interface{}{{"1", "val:n/a"}, {"2", "val:two"}, {"n/a", "val:three"}},
+		skipped:       map[string]int{},
+	},
+}
+
+func TestProcessQueryMissingModes(t *testing.T) {
+	for _, testCase := range missingModeTests {
+		iter := NewMockIter([]bson.M{
+			{"id": "1"},
+			{"id": "2", "name": "two"},
+			{"name": "three"},
+		})
+		collection := CollectionConfig{
+			Maps: []MapConfig{
+				{
+					Key:            "{{.id}}",
+					Value:          "val:{{.name}}",
+					Missing:        testCase.missing,
+					MissingDefault: "n/a",
+					HashKey:        "moredis:maps:1",
+				},
+			},
+		}
+		redigomock.Clear()
+		for _, hset := range testCase.expectedHSETs {
+			redigomock.Command("HSET", "moredis:maps:1", hset[0], hset[1]).Expect("ok")
+		}
+		writer := NewRedisWriter(redigomock.NewConn())
+		assert.Nil(t, ParseTemplates(&collection))
+		report, err := ProcessQuery(writer, iter, collection.Maps)
+		if testCase.expectedError {
+			assert.Error(t, err, "failed missing mode test: %s", testCase.name)
+		} else {
+			assert.Nil(t, err, "failed missing mode test: %s", testCase.name)
+			assert.Equal(t, len(testCase.expectedHSETs), report.Maps[0].EntriesWritten, "failed missing mode test: %s", testCase.name)
+			assert.Equal(t, 2, report.Maps[0].Missing, "failed missing mode test: %s", testCase.name)
+		}
+		assert.Equal(t, testCase.skipped, report.Maps[0].Skipped, "failed missing mode test: %s", testCase.name)
+	}
+}
+
+var missingInFunctionTests = []missingModeTestSpec{
+	{
+		name:          "unset passes nil",
+		missing:       "",
+		expectedHSETs: [][]interface{}{{"1", ":<nil>"}, {"2", "two:Two"}},
+		skipped:       map[string]int{},
+	},
+	{
+		name:          "error",
+		missing:       MissingError,
+		expectedError: true,
+		skipped:       map[string]int{},
+	},
+	{
+		name:          "skip",
+		missing:       MissingSkip,
+		expectedHSETs: [][]interface{}{{"2", "two:Two"}},
+		skipped:       map[string]int{"missing": 1},
+	},
+	{
+		name:          "empty",
+		missing:       MissingEmpty,
+		expectedHSETs: [][]interface{}{{"1", ":"}, {"2", "two:Two"}},
+		skipped:       map[string]int{},
+	},
+	{
+		name:          "default",
+		missing:       MissingDefault,
+		expectedHSETs: [][]interface{}{{"1", "n/a:N/A"}, {"2", "two:Two"}},
+		skipped:       map[string]int{},
+	},
+}
+
+func TestProcessQueryMissingInFunctions(t *testing.T) {
+	for _, testCase := range missingInFunctionTests {
+		iter := NewMockIter([]bson.M{
+			{"id": "1"},
+			{"id": "2", "name": "Two"},
+		})
+		collection := CollectionConfig{
+			Maps: []MapConfig{
+				{
+					Key:            "{{.id}}",
+					Value:          "{{toLower .name}}:{{toString .name}}",
+					Missing:        testCase.missing,
+					MissingDefault: "N/A",
+					HashKey:        "moredis:maps:1",
+				},
+			},
+		}
+		redigomock.Clear()
+		for _, hset := range testCase.expectedHSETs {
+			redigomock.Command("HSET", "moredis:maps:1", hset[0], hset[1]).Expect("ok")
+		}
+		writer := NewRedisWriter(redigomock.NewConn())
+		assert.Nil(t, ParseTemplates(&collection))
+		report, err := ProcessQuery(writer, iter, collection.Maps)
+		if testCase.expectedError {
+			assert.EqualError(t, err, "val template used a field missing from the document", testCase.name)
+		} else {
+			assert.Nil(t, err, testCase.name)
+			assert.Equal(t, len(testCase.expectedHSETs), report.Maps[0].EntriesWritten, testCase.name)
+		}
+		assert.Equal(t, 1, report.Maps[0].Missing, testCase.name)
+		assert.Equal(t, testCase.skipped, report.Maps[0].Skipped, testCase.name)
+	}
+}
+
+func TestProcessQueryMissingGuarded(t *testing.T) {
+	// guarding a field, or giving it a default, isn't using a missing field
+	iter := NewMockIter([]bson.M{{"id": "1"}})
+	collection := CollectionConfig{
+		Maps: []MapConfig{{
+			Key:     "{{.id}}",
+			Value:   `{{if .name}}{{toLower .name}}{{end}}:{{default "none" .name}}:{{toString (coalesce .alias "x")}}`,
+			Missing: MissingError,
+			HashKey: "moredis:maps:1",
+		}},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "1", ":none:x").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Maps[0].EntriesWritten)
+	assert.Equal(t, 0, report.Maps[0].Missing)
+}
+
+func TestParseTemplatesUnknownMissingMode(t *testing.T) {
+	collection := CollectionConfig{Maps: []MapConfig{{Missing: "ignore"}}}
+	assert.Error(t, ParseTemplates(&collection))
+}
+
+func TestIsTruthy(t *testing.T) {
+	for _, out := range []string{"true", "1", "yes", "active"} {
+		assert.True(t, isTruthy(out), "expected %q to be truthy", out)
+	}
+	for _, out := range []string{"", " ", "false", "FALSE", "0", "<no value>"} {
+		assert.False(t, isTruthy(out), "expected %q to be falsy", out)
+	}
+}
+
+func TestProcessQueryWhen(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "active": true},
+		{"_id": "2", "active": false},
+		{"_id": "3"},
+	})
+
+	collection := CollectionConfig{
+		Maps: []MapConfig{
+			{
+				Key:     "{{._id}}",
+				Value:   "active",
+				When:    "{{.active}}",
+				HashKey: "moredis:maps:1",
+			},
+			{
+				Key:     "{{._id}}",
+				Value:   "all",
+				HashKey: "moredis:maps:2",
+			},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "1", "active").Expect("ok")
+	for _, id := range []string{"1", "2", "3"} {
+		redigomock.Command("HSET", "moredis:maps:2", id, "all").Expect("ok")
+	}
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"when": 2}, report.Maps[0].Skipped)
+	assert.Equal(t, 3, report.Maps[1].EntriesWritten)
+}
+
+func TestProcessQueryComputed(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "first": "Ada", "last": "Lovelace", "qty": 3, "price": 2},
+		{"_id": "2", "first": "Alan", "qty": 1, "price": 4},
+		{"_id": "3", "first": "Grace", "last": "Hopper", "qty": 1234567, "price": 1.0},
+	})
+
+	collection := CollectionConfig{
+		Computed: []ComputedField{
+			{Name: "name", Expr: `first + " " + (last ?? "?")`},
+			{Name: "total", Expr: "qty * price"},
+			{Name: "bulk", Expr: "total > 5"},
+		},
+		Maps: []MapConfig{
+			{
+				Key:     "{{._id}}",
+				Value:   "{{.name}}:{{.total}}",
+				When:    "{{.bulk}}",
+				HashKey: "moredis:maps:1",
+			},
+			{Key: "{{.total}}", Value: "{{._id}}", HashKey: "moredis:maps:2"},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "1", "Ada Lovelace:6").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:1", "3", "Grace Hopper:1234567").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:2", "6", "1").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:2", "4", "2").Expect("ok")
+	// whole numbers render without an exponent, even when computed from floats
+	redigomock.Command("HSET", "moredis:maps:2", "1234567", "3").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := processQuery(context.Background(), defaultBuildOptions(), writer, iter, "", collection, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"when": 1}, report.Maps[0].Skipped)
+	assert.Equal(t, 3, report.Maps[1].EntriesWritten)
+}
+
+func TestProcessQueryComputedError(t *testing.T) {
+	iter := NewMockIter([]bson.M{{"_id": "1", "name": "Ada"}})
+	collection := CollectionConfig{
+		Computed: []ComputedField{{Name: "half", Expr: "name / 2"}},
+		Maps:     []MapConfig{{Key: "{{._id}}", Value: "{{.half}}", HashKey: "moredis:maps:1"}},
+	}
+	redigomock.Clear()
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	_, err := processQuery(context.Background(), defaultBuildOptions(), writer, iter, "", collection, nil)
+	assert.EqualError(t, err, "computed field half: can't apply / to a string and a number")
+}
@@ -0,0 +1,341 @@
+package moredis
+
+import (
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateFields works out which document fields the maps of a collection use, by walking
+// the parse trees of their templates.  It returns the dotted paths of the fields, reduced
+// so that no path is inside another.  The second return value is true if a map might use
+// any field of the document (e.g. {{toJson .}}), in which case no projection can be derived.
+// ParseTemplates must have been called on the collection.
+func templateFields(collection CollectionConfig) ([]string, bool) {
+	fields := fieldSet{}
+	// lookups and computed fields aren't read from the database, but the fields they use are
+	computed := map[string]bool{}
+	add := func(field string) {
+		path := strings.Split(field, ".")
+		if !computed[path[0]] {
+			fields.add(path)
+		}
+	}
+	for _, lookup := range collection.Lookups {
+		add(lookup.LocalField)
+		computed[lookup.As] = true
+	}
+	for _, field := range collection.Computed {
+		for _, path := range field.Expression.Paths() {
+			add(path)
+		}
+		computed[field.Name] = true
+	}
+	for _, rmap := range collection.Maps {
+		if rmap.Transform != "" || rmap.Script != "" {
+			// there's no telling which fields a transform or script uses
+			return nil, true
+		}
+		mapFields := fieldSet{}
+		templates := append([]*template.Template{rmap.KeyTemplate, rmap.ValueTemplate, rmap.WhenTemplate, rmap.ExpiresTemplate},
+			rmap.FieldTemplates...)
+		for _, tmpl := range templates {
+			if tmpl == nil || (tmpl == rmap.ValueTemplate && rmap.ValueJSON != nil) {
+				continue
+			}
+			usedFields(tmpl, &mapFields)
+		}
+		if rmap.ValueJSON != nil {
+			if len(rmap.ValueJSON.Fields) == 0 {
+				return nil, true
+			}
+			for _, field := range rmap.ValueJSON.Fields {
+				mapFields.add(strings.Split(field, "."))
+			}
+		}
+		if mapFields.all {
+			return nil, true
+		}
+		usesItem := false
+		for field := range mapFields.paths {
+			if rmap.ForEach != "" && (field == "item" || strings.HasPrefix(field, "item.")) {
+				// .item is bound to the elements at the for_each path
+				usesItem = true
+				field = rmap.ForEach + strings.TrimPrefix(field, "item")
+			}
+			add(field)
+		}
+		if rmap.ForEach != "" && !usesItem {
+			add(rmap.ForEach)
+		}
+	}
+	return fields.reduced(), false
+}
+
+// usedFields adds the fields of dot used by a template, and the templates it invokes, to fields.
+func usedFields(tmpl *template.Template, fields *fieldSet) {
+	w := &fieldWalker{tmpl: tmpl, fields: fields, walking: map[string]bool{}}
+	w.walkTemplate(tmpl.Name(), fieldContext{known: true})
+}
+
+// deriveProjection returns a projection including the fields the collection's maps use.  The
+// second return value is false if no projection could be derived.
+func deriveProjection(collection CollectionConfig) (map[string]interface{}, bool) {
+	fields, all := templateFields(collection)
+	if all || len(fields) == 0 {
+		return nil, false
+	}
+	projection := map[string]interface{}{}
+	for _, field := range fields {
+		projection[field] = 1
+	}
+	return projection, true
+}
+
+// projectionOmits returns the fields that a projection leaves out of documents.
+func projectionOmits(projection map[string]interface{}, fields []string) []string {
+	inclusion := false
+	for key, val := range projection {
+		if key != "_id" && isIncluded(val) {
+			inclusion = true
+		}
+	}
+	omitted := []string{}
+	for _, field := range fields {
+		if !projectionIncludes(projection, inclusion, field) {
+			omitted = append(omitted, field)
+		}
+	}
+	return omitted
+}
+
+// projectionIncludes reports whether a field is in documents returned with a projection.
+// An inclusion projection includes a field if it includes the field, a field containing it
+// or a field inside it, and always includes _id unless told not to.  An exclusion projection
+// includes a field unless it excludes the field or a field containing it.
+func projectionIncludes(projection map[string]interface{}, inclusion bool, field string) bool {
+	if inclusion && (field == "_id" || isSubPath(field, "_id")) {
+		val, ok := projection["_id"]
+		return !ok || isIncluded(val)
+	}
+	for key, val := range projection {
+		inside := key == field || isSubPath(field, key)
+		if inclusion && isIncluded(val) && (inside || isSubPath(key, field)) {
+			return true
+		}
+		if !inclusion && !isIncluded(val) && inside {
+			return false
+		}
+	}
+	return !inclusion
+}
+
+// isIncluded reports whether a projection value includes its field.  Values other than
+// 0 and false (e.g. $slice or $elemMatch operators) include the field.
+func isIncluded(val interface{}) bool {
+	switch val := val.(type) {
+	case bool:
+		return val
+	case float64:
+		return val != 0
+	case int:
+		return val != 0
+	default:
+		return true
+	}
+}
+
+// isSubPath reports whether path is inside parent, e.g. "a.b" is inside "a".
+func isSubPath(path, parent string) bool {
+	return strings.HasPrefix(path, parent+".")
+}
+
+// fieldSet collects dotted field paths.
+type fieldSet struct {
+	paths map[string]bool
+	// all is set if any field may be used
+	all bool
+}
+
+func (s *fieldSet) add(path []string) {
+	if len(path) == 0 {
+		s.all = true
+		return
+	}
+	if s.paths == nil {
+		s.paths = map[string]bool{}
+	}
+	s.paths[strings.Join(path, ".")] = true
+}
+
+// reduced returns the paths in sorted order, leaving out any path inside another.
+func (s fieldSet) reduced() []string {
+	sorted := make([]string, 0, len(s.paths))
+	for path := range s.paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	reduced := []string{}
+	for _, path := range sorted {
+		if len(reduced) > 0 {
+			last := reduced[len(reduced)-1]
+			if path == last || isSubPath(path, last) {
+				continue
+			}
+		}
+		reduced = append(reduced, path)
+	}
+	return reduced
+}
+
+// fieldContext is the value of dot (or a variable) while walking a template: the path of
+// the document field it holds, if known.  The zero value is an unknown value.
+type fieldContext struct {
+	path  []string
+	known bool
+}
+
+func (c fieldContext) field(idents []string) fieldContext {
+	if !c.known {
+		return c
+	}
+	path := make([]string, 0, len(c.path)+len(idents))
+	path = append(append(path, c.path...), idents...)
+	return fieldContext{path: path, known: true}
+}
+
+// fieldWalker walks a template parse tree, collecting the document fields it uses.
+type fieldWalker struct {
+	tmpl   *template.Template
+	fields *fieldSet
+	vars   map[string]fieldContext
+	// walking holds the templates being walked, to stop recursive templates
+	walking map[string]bool
+}
+
+// walkTemplate walks the named template with the given dot.
+func (w *fieldWalker) walkTemplate(name string, dot fieldContext) {
+	t := w.tmpl.Lookup(name)
+	if t == nil || t.Tree == nil {
+		return
+	}
+	if w.walking[name] {
+		// the fields a recursive template uses depend on how deep it goes
+		w.fields.all = true
+		return
+	}
+	w.walking[name] = true
+	vars := w.vars
+	w.vars = map[string]fieldContext{"$": dot}
+	w.walk(t.Tree.Root, dot)
+	w.vars = vars
+	w.walking[name] = false
+}
+
+// use records that the template uses the value in ctx.  Values that can't be traced back
+// to the document, such as the results of functions, are ignored.
+func (w *fieldWalker) use(ctx fieldContext) {
+	if ctx.known {
+		w.fields.add(ctx.path)
+	}
+}
+
+func (w *fieldWalker) walk(node parse.Node, dot fieldContext) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			w.walk(n, dot)
+		}
+	case *parse.ActionNode:
+		result := w.pipe(node.Pipe, dot)
+		if len(node.Pipe.Decl) == 0 {
+			w.use(result)
+		}
+	case *parse.IfNode:
+		w.use(w.pipe(node.Pipe, dot))
+		w.walk(node.List, dot)
+		w.walk(node.ElseList, dot)
+	case *parse.WithNode:
+		inner := w.pipe(node.Pipe, dot)
+		w.use(inner)
+		w.walk(node.List, inner)
+		w.walk(node.ElseList, dot)
+	case *parse.RangeNode:
+		// dot is each element of the ranged over field, and the path to a field of the
+		// elements of an array is the same as the path to a field of a document
+		elem := w.pipe(node.Pipe, dot)
+		w.use(elem)
+		if len(node.Pipe.Decl) == 2 {
+			// {{range $index, $elem := ...}}
+			w.vars[node.Pipe.Decl[0].Ident[0]] = fieldContext{}
+		}
+		w.walk(node.List, elem)
+		w.walk(node.ElseList, dot)
+	case *parse.TemplateNode:
+		arg := fieldContext{}
+		if node.Pipe != nil {
+			arg = w.pipe(node.Pipe, dot)
+		}
+		w.walkTemplate(node.Name, arg)
+	}
+}
+
+// pipe walks a pipeline, returning the context of its result.  Variables it declares are
+// bound to that result.
+func (w *fieldWalker) pipe(pipe *parse.PipeNode, dot fieldContext) fieldContext {
+	result := fieldContext{}
+	for ix, cmd := range pipe.Cmds {
+		if ix > 0 {
+			// the previous command's result is passed to this one
+			w.use(result)
+		}
+		result = w.command(cmd, dot)
+	}
+	for _, decl := range pipe.Decl {
+		w.vars[decl.Ident[0]] = result
+	}
+	return result
+}
+
+// command walks a command, returning the context of its result.  A command that is just a
+// value isn't recorded as used, since the caller may only use part of it, e.g.
+// {{with .a}}{{.b}}{{end}} only uses a.b.  Values passed to functions are recorded.
+func (w *fieldWalker) command(cmd *parse.CommandNode, dot fieldContext) fieldContext {
+	if len(cmd.Args) == 1 {
+		if ctx, ok := w.value(cmd.Args[0], dot); ok {
+			return ctx
+		}
+	}
+	for _, arg := range cmd.Args {
+		if ctx, ok := w.value(arg, dot); ok {
+			w.use(ctx)
+		}
+	}
+	return fieldContext{}
+}
+
+// value returns the context of a node that refers to a value, such as a field or variable.
+// The second return value is false for other nodes, such as literals and functions.
+func (w *fieldWalker) value(node parse.Node, dot fieldContext) (fieldContext, bool) {
+	switch node := node.(type) {
+	case *parse.DotNode:
+		return dot, true
+	case *parse.FieldNode:
+		return dot.field(node.Ident), true
+	case *parse.VariableNode:
+		return w.vars[node.Ident[0]].field(node.Ident[1:]), true
+	case *parse.ChainNode:
+		if ctx, ok := w.value(node.Node, dot); ok {
+			return ctx.field(node.Field), true
+		}
+		return fieldContext{}, false
+	case *parse.PipeNode:
+		return w.pipe(node, dot), true
+	default:
+		return fieldContext{}, false
+	}
+}
@@ -0,0 +1,199 @@
+package moredis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type templateFieldsTestSpec struct {
+	name     string
+	maps     []MapConfig
+	expected []string
+	all      bool
+}
+
+var templateFieldsTests = []templateFieldsTestSpec{
+	{
+		name:     "simple fields",
+		maps:     []MapConfig{{Key: "{{.email}}", Value: "{{.name}}"}},
+		expected: []string{"email", "name"},
+	},
+	{
+		name:     "fields passed to functions",
+		maps:     []MapConfig{{Key: `{{.email | toLower}}`, Value: `{{replace "-" "" .phone}}:{{toString ._id}}`}},
+		expected: []string{"_id", "email", "phone"},
+	},
+	{
+		name:     "nested fields",
+		maps:     []MapConfig{{Key: "{{.address.zip}}", Value: "{{.address.city}}"}},
+		expected: []string{"address.city", "address.zip"},
+	},
+	{
+		name:     "nested fields inside a whole field",
+		maps:     []MapConfig{{Key: "{{.address.zip}}", Value: "{{toJson .address}}"}},
+		expected: []string{"address"},
+	},
+	{
+		name:     "with and range",
+		maps:     []MapConfig{{Key: "{{with .address}}{{.zip}}{{end}}", Value: "{{range .tags}}{{.name}}{{end}}"}},
+		expected: []string{"address", "tags"},
+	},
+	{
+		name:     "variables",
+		maps:     []MapConfig{{Key: "{{$a := .address}}{{$a.zip}}", Value: "{{with .user}}{{$.email}}{{end}}"}},
+		expected: []string{"address.zip", "email", "user"},
+	},
+	{
+		name:     "conditions",
+		maps:     []MapConfig{{Key: "{{.id}}", Value: "{{if .active}}{{.name}}{{else}}{{.alias}}{{end}}", When: `{{eq .status "live"}}`}},
+		expected: []string{"active", "alias", "id", "name", "status"},
+	},
+	{
+		name: "fields from every map",
+		maps: []MapConfig{
+			{Key: "{{.email}}", Value: "{{.name}}"},
+			{Key: "{{.phone}}", Value: "{{.name}}"},
+		},
+		expected: []string{"email", "name", "phone"},
+	},
+	{
+		name:     "expires",
+		maps:     []MapConfig{{Key: "{{._id}}", Value: "{{.email}}", Expires: "{{rfc3339 .expires_at}}"}},
+		expected: []string{"_id", "email", "expires_at"},
+	},
+	{
+		name:     "entity fields and expires",
+		maps:     []MapConfig{{Key: "{{._id}}", Fields: map[string]string{"email": "{{.email}}"}, Expires: "{{.expires_at}}"}},
+		expected: []string{"_id", "email", "expires_at"},
+	},
+	{
+		name:     "for_each item",
+		maps:     []MapConfig{{Key: "{{.item.email}}", Value: "{{._id}}", ForEach: "contacts"}},
+		expected: []string{"_id", "contacts.email"},
+	},
+	{
+		name:     "for_each without item",
+		maps:     []MapConfig{{Key: "{{.id}}", Value: "1", ForEach: "contacts"}},
+		expected: []string{"contacts", "id"},
+	},
+	{
+		name:     "val_json fields",
+		maps:     []MapConfig{{Key: "{{.id}}", ValueJSON: &JSONValueConfig{Fields: []string{"name", "address.city"}}}},
+		expected: []string{"address.city", "id", "name"},
+	},
+	{
+		name: "val_json whole document",
+		maps: []MapConfig{{Key: "{{.id}}", ValueJSON: &JSONValueConfig{}}},
+		all:  true,
+	},
+	{
+		name: "whole document",
+		maps: []MapConfig{{Key: "{{.id}}", Value: "{{toJson .}}"}},
+		all:  true,
+	},
+	{
+		name: "index of the document",
+		maps: []MapConfig{{Key: `{{index . "id"}}`, Value: "1"}},
+		all:  true,
+	},
+}
+
+func TestTemplateFieldsComputed(t *testing.T) {
+	collection := CollectionConfig{
+		Computed: []ComputedField{
+			{Name: "name", Expr: `first + " " + last`},
+			{Name: "label", Expr: `lower(name) + ":" + (address.city ?? "")`},
+		},
+		Maps: []MapConfig{{Key: "{{.label}}", Value: "{{._id}}", When: "{{.name}}", HashKey: "map"}},
+	}
+	assert.NoError(t, ParseTemplates(&collection))
+	fields, all := templateFields(collection)
+	assert.False(t, all)
+	assert.Equal(t, []string{"_id", "address.city", "first", "last"}, fields)
+}
+
+func TestTemplateFields(t *testing.T) {
+	for _, spec := range templateFieldsTests {
+		collection := CollectionConfig{Maps: spec.maps}
+		for ix := range collection.Maps {
+			collection.Maps[ix].HashKey = "map"
+		}
+		assert.NoError(t, ParseTemplates(&collection), spec.name)
+		fields, all := templateFields(collection)
+		assert.Equal(t, spec.all, all, spec.name)
+		if !spec.all {
+			assert.Equal(t, spec.expected, fields, spec.name)
+		}
+	}
+}
+
+func TestDeriveProjection(t *testing.T) {
+	collection := CollectionConfig{Maps: []MapConfig{{HashKey: "map", Key: "{{.email}}", Value: "{{.address.city}}"}}}
+	assert.NoError(t, ParseTemplates(&collection))
+	projection, ok := deriveProjection(collection)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"email": 1, "address.city": 1}, projection)
+
+	collection = CollectionConfig{Maps: []MapConfig{{HashKey: "map", Key: "{{.email}}", Value: "{{toJson .}}"}}}
+	assert.NoError(t, ParseTemplates(&collection))
+	_, ok = deriveProjection(collection)
+	assert.False(t, ok)
+}
+
+type projectionOmitsTestSpec struct {
+	name       string
+	projection map[string]interface{}
+	expected   []string
+}
+
+var projectionOmitsFields = []string{"_id", "address.city", "email", "name"}
+
+var projectionOmitsTests = []projectionOmitsTestSpec{
+	{
+		name:       "inclusion including every field",
+		projection: map[string]interface{}{"email": 1.0, "name": 1.0, "address": 1.0},
+		expected:   []string{},
+	},
+	{
+		name:       "inclusion including a field inside a used field",
+		projection: map[string]interface{}{"email": 1.0, "name.first": 1.0, "address.city": true},
+		expected:   []string{},
+	},
+	{
+		name:       "inclusion missing fields",
+		projection: map[string]interface{}{"email": 1.0, "_id": 0.0},
+		expected:   []string{"_id", "address.city", "name"},
+	},
+	{
+		name:       "exclusion",
+		projection: map[string]interface{}{"address": 0.0, "phone": false},
+		expected:   []string{"address.city"},
+	},
+	{
+		name:       "exclusion of _id",
+		projection: map[string]interface{}{"_id": 0.0},
+		expected:   []string{"_id"},
+	},
+}
+
+func TestProjectionOmits(t *testing.T) {
+	for _, spec := range projectionOmitsTests {
+		assert.Equal(t, spec.expected, projectionOmits(spec.projection, projectionOmitsFields), spec.name)
+	}
+}
+
+func TestTemplateFieldsNamedTemplates(t *testing.T) {
+	collection := CollectionConfig{
+		Maps: []MapConfig{{HashKey: "map", Key: `{{template "email" .}}`, Value: `{{template "city" .address}}`}},
+		Templates: map[string]string{
+			"email":  "{{toLower .email}}",
+			"city":   "{{.city}}",
+			"unused": "{{.unused}}",
+		},
+	}
+	assert.NoError(t, ParseTemplates(&collection))
+	fields, all := templateFields(collection)
+	assert.False(t, all)
+	assert.Equal(t, []string{"address.city", "email"}, fields)
+}
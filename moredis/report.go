@@ -0,0 +1,77 @@
+package moredis
+
+import (
+	"time"
+)
+
+// BuildReport describes a build of a cache: what was read from mongo and written to
+// redis for each collection and map.
+type BuildReport struct {
+	Cache       string             `json:"cache"`
+	BuildID     string             `json:"build_id"`
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Collections []CollectionReport `json:"collections"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// CollectionReport describes the build of the maps for a single collection.
+type CollectionReport struct {
+	Collection       string      `json:"collection"`
+	DocumentsScanned int         `json:"documents_scanned"`
+	Timings          Timings     `json:"timings"`
+	Maps             []MapReport `json:"maps"`
+	Error            string      `json:"error,omitempty"`
+}
+
+// Timings breaks down where the time building a collection's maps went.  Query is time
+// spent waiting on mongo, Render is time spent executing templates, Write is time spent
+// sending entries to redis and Swap is time spent updating map references.
+type Timings struct {
+	Query  time.Duration `json:"query_ns"`
+	Render time.Duration `json:"render_ns"`
+	Write  time.Duration `json:"write_ns"`
+	Swap   time.Duration `json:"swap_ns"`
+}
+
+// MapReport describes the build of a single map.  Skipped counts documents that produced
+// no entry, by reason.  Missing counts documents whose key or val used a field they didn't
+// have, however that was handled.  Collisions counts entries that overwrote an entry
+// written earlier in the same build.  NotifyError is set if the map was swapped but the
+// swap notification couldn't be sent.
+type MapReport struct {
+	Name           string         `json:"name"`
+	OldHashKey     string         `json:"old_hash_key"`
+	NewHashKey     string         `json:"new_hash_key"`
+	EntriesWritten int            `json:"entries_written"`
+	Skipped        map[string]int `json:"skipped"`
+	Missing        int            `json:"missing"`
+	Collisions     int            `json:"collisions"`
+	Checksum       string         `json:"checksum"`
+	NotifyError    string         `json:"notify_error,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// newCollectionReport returns an empty report for the collection, with a report for each map.
+func newCollectionReport(collection CollectionConfig) CollectionReport {
+	report := CollectionReport{
+		Collection: collection.Collection,
+		Maps:       make([]MapReport, len(collection.Maps)),
+	}
+	for ix, rmap := range collection.Maps {
+		report.Maps[ix] = MapReport{
+			Name:       rmap.Name,
+			NewHashKey: rmap.HashKey,
+			Skipped:    map[string]int{},
+		}
+	}
+	return report
+}
+
+// finish marks the build as complete, failed with err if it is non-nil.
+func (r *BuildReport) finish(err error) {
+	r.End = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
@@ -0,0 +1,160 @@
+package moredis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultScriptTimeout is how long a map's script can run for each document, if the map
+// doesn't set script_timeout.
+const defaultScriptTimeout = 100 * time.Millisecond
+
+// scriptLibs are the Lua standard libraries available to scripts.  Libraries that reach
+// outside the interpreter, like os and io, are left out.
+var scriptLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// compileScript compiles a map's Lua script into a Transform.  The script runs once per
+// document with the document in the global doc, and returns either a key and a value, or
+// a table of keys to values, or nil for no entries.  Each run is limited to timeout, which
+// is a duration like "50ms", or defaultScriptTimeout if it is empty.
+func compileScript(name, script, timeout string) (Transform, error) {
+	limit := defaultScriptTimeout
+	if timeout != "" {
+		var err error
+		if limit, err = time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid script_timeout: %s", err)
+		}
+	}
+	chunk, err := parse.Parse(strings.NewReader(script), name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newScriptState()
+	// Lua states can't be used concurrently
+	var mu sync.Mutex
+	return func(doc bson.M) ([]Entry, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), limit)
+		defer cancel()
+		state.SetContext(ctx)
+		defer state.RemoveContext()
+
+		state.SetGlobal("doc", luaValue(state, doc))
+		state.Push(state.NewFunctionFromProto(proto))
+		if err := state.PCall(0, 2, nil); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("%s: script exceeded its time limit of %s", name, limit)
+			}
+			return nil, err
+		}
+		first, second := state.Get(-2), state.Get(-1)
+		state.Pop(2)
+		return scriptEntries(first, second), nil
+	}, nil
+}
+
+// newScriptState creates a Lua state with the libraries in scriptLibs.
+func newScriptState() *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range scriptLibs {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	// the base library can read files
+	state.SetGlobal("dofile", lua.LNil)
+	state.SetGlobal("loadfile", lua.LNil)
+	return state
+}
+
+// scriptEntries converts the values returned by a script into entries.
+func scriptEntries(first, second lua.LValue) []Entry {
+	switch first := first.(type) {
+	case *lua.LTable:
+		entries := []Entry{}
+		first.ForEach(func(key, val lua.LValue) {
+			entries = append(entries, Entry{Key: luaString(key), Value: luaString(val)})
+		})
+		// table iteration order is undefined, so sort for a deterministic write order
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		return entries
+	case *lua.LNilType:
+		return nil
+	default:
+		return []Entry{{Key: luaString(first), Value: luaString(second)}}
+	}
+}
+
+// luaString converts a value returned by a script to a string for redis.
+func luaString(val lua.LValue) string {
+	switch val := val.(type) {
+	case lua.LString, lua.LNumber:
+		return lua.LVAsString(val)
+	case *lua.LNilType:
+		return ""
+	default:
+		return val.String()
+	}
+}
+
+// luaValue converts a document value into a Lua value.  Documents and arrays become
+// tables, and ObjectIds, dates and other bson types become the strings that templates
+// render them as.
+func luaValue(state *lua.LState, val interface{}) lua.LValue {
+	switch val := val.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(val)
+	case string:
+		return lua.LString(val)
+	case int:
+		return lua.LNumber(val)
+	case int32:
+		return lua.LNumber(val)
+	case int64:
+		return lua.LNumber(val)
+	case float64:
+		return lua.LNumber(val)
+	case time.Time:
+		return lua.LString(formatRFC3339(val))
+	case bson.M:
+		table := state.CreateTable(0, len(val))
+		for key, field := range val {
+			table.RawSetString(key, luaValue(state, field))
+		}
+		return table
+	case map[string]interface{}:
+		return luaValue(state, bson.M(val))
+	case []interface{}:
+		table := state.CreateTable(len(val), 0)
+		for _, item := range val {
+			table.Append(luaValue(state, item))
+		}
+		return table
+	default:
+		return lua.LString(toString(val))
+	}
+}
@@ -0,0 +1,119 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type scriptTestSpec struct {
+	name     string
+	script   string
+	doc      bson.M
+	expected []Entry
+}
+
+var scriptTests = []scriptTestSpec{
+	{
+		name:     "key and value",
+		script:   `return string.lower(doc.email), doc._id`,
+		doc:      bson.M{"_id": bson.ObjectIdHex("5643ad1f7b3e5a0001000001"), "email": "A@X.COM"},
+		expected: []Entry{{Key: "a@x.com", Value: "5643ad1f7b3e5a0001000001"}},
+	},
+	{
+		name: "table of entries with conditions and arithmetic",
+		script: `
+local out = {}
+for _, item in ipairs(doc.items) do
+  if item.qty > 1 then
+    out[item.sku] = item.qty * item.price
+  end
+end
+return out`,
+		doc: bson.M{"items": []interface{}{
+			bson.M{"sku": "b", "qty": 2, "price": 1.5},
+			bson.M{"sku": "a", "qty": int64(3), "price": 2},
+			bson.M{"sku": "c", "qty": 1, "price": 10},
+		}},
+		expected: []Entry{{Key: "a", Value: "6"}, {Key: "b", Value: "3"}},
+	},
+	{
+		name:     "nil",
+		script:   `if not doc.active then return nil end return doc.id, "1"`,
+		doc:      bson.M{"id": "x", "active": false},
+		expected: nil,
+	},
+	{
+		name:     "dates",
+		script:   `return doc.id, doc.created`,
+		doc:      bson.M{"id": "x", "created": time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)},
+		expected: []Entry{{Key: "x", Value: "2016-01-02T03:04:05Z"}},
+	},
+}
+
+func TestCompileScript(t *testing.T) {
+	for _, spec := range scriptTests {
+		fn, err := compileScript("test", spec.script, "")
+		if !assert.NoError(t, err, spec.name) {
+			continue
+		}
+		entries, err := fn(spec.doc)
+		assert.NoError(t, err, spec.name)
+		assert.Equal(t, spec.expected, entries, spec.name)
+	}
+}
+
+func TestCompileScriptErrors(t *testing.T) {
+	_, err := compileScript("test", "return (", "")
+	assert.Error(t, err)
+	_, err = compileScript("test", "return 1", "soon")
+	assert.EqualError(t, err, `invalid script_timeout: time: invalid duration "soon"`)
+
+	fn, err := compileScript("test", `error("bad document")`, "")
+	assert.NoError(t, err)
+	_, err = fn(bson.M{})
+	assert.Contains(t, err.Error(), "bad document")
+
+	// scripts can't reach outside the interpreter
+	fn, err = compileScript("test", `return os.getenv("HOME"), "1"`, "")
+	assert.NoError(t, err)
+	_, err = fn(bson.M{})
+	assert.Error(t, err)
+
+	fn, err = compileScript("test", `if doc.loop then while true do end end return doc.id, "1"`, "20ms")
+	assert.NoError(t, err)
+	_, err = fn(bson.M{"loop": true})
+	assert.EqualError(t, err, "test: script exceeded its time limit of 20ms")
+	// the script can still be run after a timeout
+	entries, err := fn(bson.M{"id": "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "x", Value: "1"}}, entries)
+}
+
+func TestProcessQueryScript(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "tags": []interface{}{"a", "b"}},
+		{"_id": "2"},
+	})
+	collection := CollectionConfig{
+		Maps: []MapConfig{{
+			HashKey: "moredis:maps:1",
+			Script: `
+local out = {}
+for _, tag in ipairs(doc.tags or {}) do out[tag .. ":" .. doc._id] = "1" end
+return out`,
+		}},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "a:1", "1").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:1", "b:1", "1").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.NoError(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"no_entries": 1}, report.Maps[0].Skipped)
+}
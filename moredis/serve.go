@@ -0,0 +1,331 @@
+package moredis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Clever/moredis/client"
+	"github.com/Clever/moredis/logger"
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxBatchKeys is the most keys that can be looked up in one batch request.
+const maxBatchKeys = 1000
+
+// kindCacheSize is how many builds of maps the Server remembers the kind of.
+const kindCacheSize = 1000
+
+// Server serves lookups of the maps built by moredis as an HTTP/JSON API:
+//
+//	GET  /maps/{name}/{key}  the value of key in the map
+//	POST /maps/{name}        the values of the keys in a {"keys": [...]} body
+//	GET  /maps/{name}        the metadata of the map
+//	GET  /health             whether redis can be reached
+//	GET  /metrics            prometheus metrics
+type Server struct {
+	pool   RedisPool
+	client *client.Client
+	cache  *lruCache
+	// kinds caches whether each build of a map is an entity map, as the found flag of its
+	// entry, since a build's kind never changes
+	kinds *lruCache
+	mux   *http.ServeMux
+	now   func() time.Time
+
+	// noFieldTTL is set once redis rejects HPEXPIRETIME for being too old to expire the
+	// fields of a hash, after which entries are cached without an expiry
+	noFieldTTL int32
+}
+
+// NewServer creates a Server that reads maps from connections from pool, caching up to
+// cacheSize entries in memory.  The options configure the client used to read maps.
+func NewServer(pool RedisPool, cacheSize int, options ...client.Option) *Server {
+	s := &Server{
+		pool:   pool,
+		client: client.New(pool, options...),
+		cache:  newLRUCache(cacheSize),
+		kinds:  newLRUCache(kindCacheSize),
+		mux:    http.NewServeMux(),
+		now:    time.Now,
+	}
+	s.mux.Handle("/maps/", s.instrument("maps", s.serveMaps))
+	s.mux.Handle("/health", s.instrument("health", s.serveHealth))
+	s.mux.Handle("/metrics", MetricsHandler())
+	return s
+}
+
+// Client returns the client the Server reads maps with, e.g. to Watch for swaps.
+func (s *Server) Client() *client.Client {
+	return s.client
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument records request metrics for a handler, labelled with endpoint.
+func (s *Server) instrument(endpoint string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler(rec, r)
+		serveDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		serveRequests.WithLabelValues(endpoint, strconv.Itoa(rec.code)).Inc()
+	})
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveMaps routes requests for /maps/{name} and /maps/{name}/{key}.  Keys can contain
+// slashes.
+func (s *Server) serveMaps(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/maps/")
+	mapName, key, hasKey := path, "", false
+	if ix := strings.Index(path, "/"); ix >= 0 {
+		mapName, key, hasKey = path[:ix], path[ix+1:], true
+	}
+	if mapName == "" {
+		writeError(w, http.StatusNotFound, "no map name given")
+		return
+	}
+
+	switch {
+	case hasKey && r.Method == http.MethodGet:
+		s.serveLookup(w, r, mapName, key)
+	case !hasKey && r.Method == http.MethodGet:
+		s.serveMetadata(w, r, mapName)
+	case !hasKey && r.Method == http.MethodPost:
+		s.serveBatch(w, r, mapName)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed", r.Method))
+	}
+}
+
+func (s *Server) serveLookup(w http.ResponseWriter, r *http.Request, mapName, key string) {
+	values, err := s.lookup(r.Context(), mapName, []string{key})
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	val, ok := values[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("map %s has no entry for %q", mapName, key))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"map": mapName, "key": key, "value": val})
+}
+
+// batchRequest is the body of a batch lookup.
+type batchRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// batchResponse holds the values found by a batch lookup.  Keys the map has no entry for
+// are left out.
+type batchResponse struct {
+	Map    string            `json:"map"`
+	Values map[string]string `json:"values"`
+}
+
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, mapName string) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid batch request: %s", err))
+		return
+	}
+	if len(req.Keys) > maxBatchKeys {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("batch requests can look up at most %d keys", maxBatchKeys))
+		return
+	}
+	values, err := s.lookup(r.Context(), mapName, req.Keys)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, batchResponse{Map: mapName, Values: values})
+}
+
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request, mapName string) {
+	hashKey, err := s.client.Resolve(r.Context(), mapName)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	meta, ok, err := readMapMetadata(conn, hashKey)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("map %s has no metadata", mapName))
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// lookup returns the values of keys in the map mapName, using cached entries from the hash
+// the map currently refers to.  All of the values come from the same build of the map.
+func (s *Server) lookup(ctx context.Context, mapName string, keys []string) (map[string]string, error) {
+	values := map[string]string{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+	hashKey, err := s.client.Resolve(ctx, mapName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkHashMap(mapName, hashKey); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	var misses []string
+	for _, key := range keys {
+		entry, ok := s.cache.get(hashKey, key)
+		if !ok {
+			misses = append(misses, key)
+			continue
+		}
+		if entry.found && !entry.expired(now) {
+			values[key] = entry.val
+		}
+	}
+	serveCacheLookups.WithLabelValues("hit").Add(float64(len(keys) - len(misses)))
+	serveCacheLookups.WithLabelValues("miss").Add(float64(len(misses)))
+	if len(misses) == 0 {
+		return values, nil
+	}
+
+	missHashKey, missValues, err := s.client.LookupManyIn(ctx, mapName, misses)
+	if err != nil {
+		return nil, err
+	}
+	if missHashKey != hashKey {
+		// the map was swapped after it was resolved, so the cached values are from the
+		// previous build; read all of the keys from the new one
+		values = map[string]string{}
+		misses = keys
+		if missHashKey, missValues, err = s.client.LookupManyIn(ctx, mapName, keys); err != nil {
+			return nil, err
+		}
+	}
+	expiries, err := s.fieldExpiries(missHashKey, misses, missValues)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range misses {
+		val, found := missValues[key]
+		expireAt := expiries[key]
+		s.cache.add(missHashKey, key, val, found, expireAt)
+		if found && (expireAt.IsZero() || now.Before(expireAt)) {
+			values[key] = val
+		}
+	}
+	return values, nil
+}
+
+// fieldExpiries returns when the entries of keys found in hashKey expire, leaving out the
+// entries that don't, so that cached entries stop being served once redis expires them.
+func (s *Server) fieldExpiries(hashKey string, keys []string, found map[string]string) (map[string]time.Time, error) {
+	expiries := map[string]time.Time{}
+	var fields []string
+	for _, key := range keys {
+		if _, ok := found[key]; ok {
+			fields = append(fields, key)
+		}
+	}
+	if len(fields) == 0 || atomic.LoadInt32(&s.noFieldTTL) == 1 {
+		return expiries, nil
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	times, err := hashFieldExpiries(conn, hashKey, fields)
+	if _, ok := err.(redis.Error); ok && !hashFieldTTLSupported(conn) {
+		atomic.StoreInt32(&s.noFieldTTL, 1)
+		return expiries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for ix, field := range fields {
+		if !times[ix].IsZero() {
+			expiries[field] = times[ix]
+		}
+	}
+	return expiries, nil
+}
+
+// checkHashMap returns an entityMapError if the build of mapName stored under hashKey is
+// an entity map, whose entities can't be looked up as entries.
+func (s *Server) checkHashMap(mapName, hashKey string) error {
+	entry, ok := s.kinds.get(hashKey, "")
+	if !ok {
+		conn := s.pool.Get()
+		defer conn.Close()
+		entity, err := isEntityMap(conn, hashKey)
+		if err != nil {
+			return err
+		}
+		entry.found = entity
+		s.kinds.add(hashKey, "", "", entity, time.Time{})
+	}
+	if entry.found {
+		return entityMapError{mapName}
+	}
+	return nil
+}
+
+// writeLookupError writes the response for an error looking up a map.
+func writeLookupError(w http.ResponseWriter, err error) {
+	if _, ok := err.(entityMapError); ok {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case client.ErrNoMap:
+		writeError(w, http.StatusNotFound, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		logger.Error("Failed to look up map", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("Failed to write response", err)
+	}
+}
@@ -0,0 +1,169 @@
+package moredis
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockPool struct{}
+
+func (mockPool) Get() redis.Conn { return redigomock.NewConn() }
+
+// serveRequest sends a request to s, returning the status code and decoded JSON body.
+func serveRequest(t *testing.T, s *Server, method, path, body string) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded), path)
+	return rec.Code, decoded
+}
+
+func TestServeLookup(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	redigomock.GenericCommand("HGET").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice")})
+	// redis older than 7.4 can't expire entries, so they're cached without an expiry
+	redigomock.GenericCommand("HPEXPIRETIME").ExpectError(redis.Error("ERR unknown command 'HPEXPIRETIME'"))
+	s := NewServer(mockPool{}, 10)
+
+	code, body := serveRequest(t, s, "GET", "/maps/users/a/b", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"map": "users", "key": "a/b", "value": "alice"}, body)
+
+	// the entry is now cached for the map's hash, so redis is only asked for the reference
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	code, body = serveRequest(t, s, "GET", "/maps/users/a/b", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "alice", body["value"])
+
+	// swapping the map stops the cached entry being used
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:2")
+	redigomock.GenericCommand("HGET").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("moredis:maps:2"), nil})
+	code, body = serveRequest(t, s, "GET", "/maps/users/a/b", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, `map users has no entry for "a/b"`, body["error"])
+
+	redigomock.Command("GET", "nope").ExpectError(redis.ErrNil)
+	code, _ = serveRequest(t, s, "GET", "/maps/nope/a", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = serveRequest(t, s, "DELETE", "/maps/users/a", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// entity maps can't be looked up as entries
+	redigomock.Clear()
+	redigomock.Command("GET", "user").Expect("moredis:maps:3")
+	redigomock.Command("HGET", "moredis:maps:3:meta", "kind").Expect(MapKindEntity)
+	code, body = serveRequest(t, s, "GET", "/maps/user/a", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "map user is an entity map, which can't be read as a single hash", body["error"])
+}
+
+func TestServeLookupExpires(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	redigomock.GenericCommand("HGET").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice"), []byte("bob")})
+	redigomock.Command("HPEXPIRETIME", "moredis:maps:1", "FIELDS", 2, "a", "b").
+		Expect([]interface{}{epochMillis(now.Add(time.Minute)), int64(-1)})
+	s := NewServer(mockPool{}, 10)
+	s.now = func() time.Time { return now }
+
+	code, body := serveRequest(t, s, "POST", "/maps/users", `{"keys": ["a", "b"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"a": "alice", "b": "bob"}, body["values"])
+
+	// once redis has expired the entry, its cached value stops being served
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	now = now.Add(time.Minute)
+	code, body = serveRequest(t, s, "POST", "/maps/users", `{"keys": ["a", "b"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"b": "bob"}, body["values"])
+}
+
+func TestServeBatch(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	redigomock.GenericCommand("HGET").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("moredis:maps:1"), []byte("alice"), nil})
+	redigomock.GenericCommand("HPEXPIRETIME").ExpectError(redis.Error("ERR unknown command 'HPEXPIRETIME'"))
+	s := NewServer(mockPool{}, 10)
+
+	code, body := serveRequest(t, s, "POST", "/maps/users", `{"keys": ["a", "b"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"map": "users", "values": map[string]interface{}{"a": "alice"}}, body)
+
+	code, _ = serveRequest(t, s, "POST", "/maps/users", `{"keys": "a"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestServeMetadata(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GET", "users").Expect("moredis:maps:1")
+	redigomock.Command("HGETALL", "moredis:maps:1:meta").ExpectMap(map[string]string{
+		"hash_key":    "moredis:maps:1",
+		"build_id":    "abc",
+		"build_start": "2016-01-01T00:00:00Z",
+		"build_end":   "2016-01-01T00:00:05Z",
+		"documents":   "2",
+		"entries":     "1",
+		"params":      `{}`,
+	})
+	s := NewServer(mockPool{}, 10)
+
+	code, body := serveRequest(t, s, "GET", "/maps/users", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "abc", body["build_id"])
+	assert.Equal(t, 2.0, body["documents"])
+}
+
+func TestServeHealth(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("PING").Expect("PONG")
+	s := NewServer(mockPool{}, 10)
+	code, body := serveRequest(t, s, "GET", "/health", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+
+	redigomock.Clear()
+	redigomock.Command("PING").ExpectError(errors.New("connection refused"))
+	code, body = serveRequest(t, s, "GET", "/health", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "connection refused", body["error"])
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("h", "a", "1", true, time.Time{})
+	c.add("h", "b", "", false, time.Time{})
+	_, ok := c.get("h", "a")
+	assert.True(t, ok)
+	// b is now the least recently used, so it is evicted
+	c.add("h", "c", "3", true, time.Time{})
+	_, ok = c.get("h", "b")
+	assert.False(t, ok)
+	entry, ok := c.get("h", "a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", entry.val)
+	_, ok = c.get("other", "a")
+	assert.False(t, ok)
+
+	disabled := newLRUCache(0)
+	disabled.add("h", "a", "1", true, time.Time{})
+	_, ok = disabled.get("h", "a")
+	assert.False(t, ok)
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,24 +17,65 @@ import (
 // funcMap defines functions that are exported to the templates used
 // by the config yaml.
 var funcMap = template.FuncMap{
-	"toLower":  safeToLower,
-	"toString": toString,
-	"toSet":    toSet,
-	"toJson":   toJSON,
+	"toLower":        safeToLower,
+	"toUpper":        stringFunc(strings.ToUpper),
+	"toString":       toString,
+	"toSet":          toSet,
+	"toJson":         toJSON,
+	"trim":           stringFunc(strings.TrimSpace),
+	"replace":        replace,
+	"regexReplace":   regexReplace,
+	"split":          split,
+	"join":           join,
+	"default":        defaultVal,
+	"coalesce":       coalesce,
+	"substr":         substr,
+	"formatNumber":   formatNumber,
+	"md5":            stringFunc(hashMD5),
+	"sha1":           stringFunc(hashSHA1),
+	"sha256":         stringFunc(hashSHA256),
+	"fnv":            stringFunc(hashFNV),
+	"base64Encode":   stringFunc(base64Encode),
+	"base64Decode":   stringFunc(base64Decode),
+	"urlEncode":      stringFunc(url.QueryEscape),
+	"urlDecode":      stringFunc(urlDecode),
+	"normalizeEmail": stringFunc(normalizeEmail),
+	"now":            now,
+	"daysAgo":        daysAgo,
+	"hoursAgo":       hoursAgo,
+	"rfc3339":        formatRFC3339,
+	"unix":           unixSeconds,
+	"unixMillis":     unixMillis,
+	"formatDate":     formatDate,
+	"parseDate":      parseDate,
+	"inTimezone":     inTimezone,
+	"addDuration":    addDuration,
+	"addDays":        addDays,
+}
+
+// queryFuncMap defines the functions exported to the query and projection templates
+// used by the config yaml.  It is funcMap with queryFuncs in place of the date functions.
+var queryFuncMap = template.FuncMap{}
+
+func init() {
+	for name, fn := range funcMap {
+		queryFuncMap[name] = fn
+	}
+	for name, fn := range queryFuncs {
+		queryFuncMap[name] = fn
+	}
 }
 
 // toString is a function that is exported to templates to allow
 // converting non-string objects to strings.  Normally we would
 // let types do this themselves by implementing Stringer interface
 // (which is what Sprint will do) but for ObjectId's, it's more
-// useful to get the Hex value.
+// useful to get the Hex value, and for binary UUIDs the canonical form.
 func toString(toConvert interface{}) string {
-	switch toConvert := toConvert.(type) {
-	case bson.ObjectId:
-		return toConvert.Hex()
-	default:
-		return fmt.Sprint(toConvert)
+	if str, ok := asString(toConvert); ok {
+		return str
 	}
+	return fmt.Sprint(toConvert)
 }
 
 // safeToLower is a function that is exported to templates as 'toLower'
@@ -40,12 +83,11 @@ func toString(toConvert interface{}) string {
 // just exporting strings.ToLower is we need to be able to handle
 // non-strings in a consistent way.
 func safeToLower(toConvert interface{}) string {
-	switch toConvert := toConvert.(type) {
-	case string:
-		return strings.ToLower(toConvert)
-	default:
+	str, ok := asString(toConvert)
+	if !ok {
 		return ""
 	}
+	return strings.ToLower(str)
 }
 
 // toSet is a function that is exported to templates as 'toSet'
@@ -87,11 +129,12 @@ func toSet(toConvert interface{}) string {
 
 // toJSON is a function that is exported to templates as 'toJson'
 // to allow converting mongo objects to json.  If the object passed in
-// is not a mongo object, it is unaffected.
+// is not a mongo object, it is unaffected.  bson types inside the object
+// are converted the same way as for val_json maps.
 func toJSON(toConvert interface{}) interface{} {
 	switch toConvert := toConvert.(type) {
 	case bson.M:
-		marshalled, err := json.Marshal(toConvert)
+		marshalled, err := json.Marshal(jsonValue(toConvert))
 		if err != nil {
 			// can't marshal, just return it
 			return toConvert
@@ -103,16 +146,82 @@ func toJSON(toConvert interface{}) interface{} {
 }
 
 // ParseTemplates takes a collection config and parses the templates
-// for all of the contained maps.
+// for all of the contained maps, and looks up or compiles their transforms.  It also
+// parses the expressions of the collection's computed fields.
 func ParseTemplates(collection *CollectionConfig) error {
+	for ix, field := range collection.Computed {
+		expr, err := ParseExpression(field.Expr)
+		if err != nil {
+			return fmt.Errorf("computed field %s: %s", field.Name, err)
+		}
+		collection.Computed[ix].Expression = expr
+	}
 	for ix, rmap := range collection.Maps {
-		keyTmpl, err := template.New(rmap.HashKey + ":key").Funcs(funcMap).Parse(rmap.Key)
+		if err := checkAggregate(rmap.Aggregate); err != nil {
+			return err
+		}
+		ttl, err := parseTTL(rmap.TTL)
+		if err != nil {
+			return err
+		}
+		collection.Maps[ix].TTLDuration = ttl
+		if rmap.When != "" {
+			whenTmpl, err := newTemplate(rmap.HashKey+":when", rmap.When, funcMap, collection.Templates)
+			if err != nil {
+				return err
+			}
+			collection.Maps[ix].WhenTemplate = whenTmpl
+		}
+		if rmap.Transform != "" {
+			fn, err := lookupTransform(rmap.Transform)
+			if err != nil {
+				return err
+			}
+			collection.Maps[ix].TransformFunc = fn
+			continue
+		}
+		if rmap.Script != "" {
+			fn, err := compileScript(rmap.HashKey+":script", rmap.Script, rmap.ScriptTimeout)
+			if err != nil {
+				return err
+			}
+			collection.Maps[ix].TransformFunc = fn
+			continue
+		}
+
+		if err := checkMissingMode(rmap.Missing); err != nil {
+			return err
+		}
+		tracker := newMissingTracker(rmap)
+		collection.Maps[ix].missingFields = tracker
+		funcs := tracker.wrapFuncs(funcMap)
+
+		if rmap.Expires != "" {
+			if rmap.Aggregate != "" {
+				return fmt.Errorf("expires can't be used with aggregate")
+			}
+			// missing fields render as "<no value>", for entries that don't expire
+			expiresTmpl, err := newTemplate(rmap.HashKey+":expires", rmap.Expires, funcMap, collection.Templates)
+			if err != nil {
+				return err
+			}
+			collection.Maps[ix].ExpiresTemplate = expiresTmpl
+		}
+
+		keyTmpl, err := newTemplate(rmap.HashKey+":key", rmap.Key, funcs, collection.Templates)
 		if err != nil {
 			return err
 		}
 		collection.Maps[ix].KeyTemplate = keyTmpl
 
-		valTmpl, err := template.New(rmap.HashKey + ":val").Funcs(funcMap).Parse(rmap.Value)
+		if len(rmap.Fields) > 0 {
+			if err := parseFields(&collection.Maps[ix], collection.Templates, funcs); err != nil {
+				return err
+			}
+			continue
+		}
+
+		valTmpl, err := newTemplate(rmap.HashKey+":val", rmap.Value, funcs, collection.Templates)
 		if err != nil {
 			return err
 		}
@@ -121,11 +230,99 @@ func ParseTemplates(collection *CollectionConfig) error {
 	return nil
 }
 
+// newTemplate parses a template with the given functions, options and named templates, which
+// it can invoke with {{template "name" .}}
+func newTemplate(name, text string, funcs template.FuncMap, named map[string]string, options ...string) (*template.Template, error) {
+	tmpl := template.New(name).Funcs(funcs).Option(options...)
+	for namedName, namedText := range named {
+		if _, err := tmpl.New(namedName).Parse(namedText); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl.Parse(text)
+}
+
+// checkMissingMode checks that missing is one of the Missing* constants, or empty.
+func checkMissingMode(missing string) error {
+	switch missing {
+	case "", MissingError, MissingSkip, MissingEmpty, MissingDefault:
+		return nil
+	default:
+		return fmt.Errorf("unknown missing mode %q, must be one of error, skip, empty or default", missing)
+	}
+}
+
+// handlesMissing lists the template functions meant to be given missing fields, which
+// aren't counted as using them.
+var handlesMissing = map[string]bool{"default": true, "coalesce": true}
+
+// missingTracker records whether a map's key, val or field templates used a field missing
+// from the document.  Templates print missing fields as "<no value>", but pass them to
+// functions as nil, so the functions of the map's templates are wrapped to record nil
+// arguments.  For missing: empty and missing: default they also pass "" or the map's
+// default value in place of nil, so that e.g. {{toString .x}} doesn't render as "<nil>";
+// other modes pass nil on unchanged.  A map's templates are only executed by one goroutine
+// at a time.
+type missingTracker struct {
+	missing bool
+	// replacement is passed in place of nil arguments, unless it is the zero Value
+	replacement reflect.Value
+}
+
+func newMissingTracker(rmap MapConfig) *missingTracker {
+	switch rmap.Missing {
+	case MissingEmpty:
+		return &missingTracker{replacement: reflect.ValueOf("")}
+	case MissingDefault:
+		return &missingTracker{replacement: reflect.ValueOf(rmap.MissingDefault)}
+	default:
+		return &missingTracker{}
+	}
+}
+
+// wrapFuncs returns funcs with each function wrapped to record nil arguments in t.
+func (t *missingTracker) wrapFuncs(funcs template.FuncMap) template.FuncMap {
+	wrapped := make(template.FuncMap, len(funcs))
+	for name, fn := range funcs {
+		if handlesMissing[name] {
+			wrapped[name] = fn
+			continue
+		}
+		wrapped[name] = t.wrap(fn)
+	}
+	return wrapped
+}
+
+func (t *missingTracker) wrap(fn interface{}) interface{} {
+	fnVal := reflect.ValueOf(fn)
+	fnType := fnVal.Type()
+	return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
+		for ix, arg := range args {
+			if arg.Kind() == reflect.Interface && arg.IsNil() {
+				t.missing = true
+				if t.replacement.IsValid() && t.replacement.Type().AssignableTo(arg.Type()) {
+					args[ix] = t.replacement
+				}
+			}
+		}
+		if fnType.IsVariadic() {
+			return fnVal.CallSlice(args)
+		}
+		return fnVal.Call(args)
+	}).Interface()
+}
+
 // ApplyTemplate takes a template string and a map of values to use
 // for evaluating the template.  Returns the evaluated template as
 // a string or an error.
 func ApplyTemplate(templateString string, payload bson.M) (string, error) {
-	tmpl, err := template.New("").Funcs(funcMap).Parse(templateString)
+	return applyTemplate(templateString, payload, funcMap, nil)
+}
+
+// applyTemplate does the work of ApplyTemplate, with the given functions and named templates
+// available to the template.
+func applyTemplate(templateString string, payload bson.M, funcs template.FuncMap, named map[string]string) (string, error) {
+	tmpl, err := newTemplate("", templateString, funcs, named)
 	if err != nil {
 		return "", err
 	}
@@ -142,9 +339,17 @@ func ApplyTemplate(templateString string, payload bson.M) (string, error) {
 // The template string must evaluate to a valid JSON object.  This means
 // that all keys must be strings.  For mongo operators, you should
 // encase them in quotes, for example "$or".  For ObjectIds, you should
-// use the hex string in place of the ObjectId.
+// use the hex string in place of the ObjectId.  For dates, you should use
+// MongoDB extended JSON ({"$date": "<RFC3339>"}), which is what date
+// functions like now and daysAgo render as in these templates.
 func ParseTemplatedJSON(query string, params Params) (map[string]interface{}, error) {
-	parsed, err := ApplyTemplate(query, params.Bson())
+	return parseTemplatedJSON(query, params, nil)
+}
+
+// parseTemplatedJSON does the work of ParseTemplatedJSON, with the given named templates
+// available to the template.
+func parseTemplatedJSON(query string, params Params, named map[string]string) (map[string]interface{}, error) {
+	parsed, err := applyTemplate(query, params.Bson(), queryFuncMap, named)
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
@@ -156,17 +361,32 @@ func ParseTemplatedJSON(query string, params Params) (map[string]interface{}, er
 	return queryObject, nil
 }
 
-// setObjectIds recursively searches a map for string values that can
-// be converted to mongo ObjectIds.  The map is mutated in place.
+// setObjectIds recursively searches a map, and the arrays in it, for string values that
+// can be converted to mongo ObjectIds, and extended JSON dates that can be converted to
+// mongo dates.  The map is mutated in place.
 func setObjectIds(part map[string]interface{}) {
 	for key, val := range part {
-		switch val := val.(type) {
-		case string:
-			if bson.IsObjectIdHex(val) {
-				part[key] = bson.ObjectIdHex(val)
-			}
-		case map[string]interface{}:
-			setObjectIds(val)
+		part[key] = convertQueryValue(val)
+	}
+}
+
+// convertQueryValue converts a value of a query as setObjectIds does, mutating maps and
+// arrays in place, so that operators like $or and $in get dates and ObjectIds too.
+func convertQueryValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case string:
+		if bson.IsObjectIdHex(val) {
+			return bson.ObjectIdHex(val)
+		}
+	case map[string]interface{}:
+		if date, ok := extendedJSONDate(val); ok {
+			return date
+		}
+		setObjectIds(val)
+	case []interface{}:
+		for ix, elem := range val {
+			val[ix] = convertQueryValue(elem)
 		}
 	}
+	return val
 }
@@ -2,6 +2,7 @@ package moredis
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/mgo.v2/bson"
@@ -189,6 +190,18 @@ var parseTemplatedJSONTests = []parseTemplatedJSONTestSpec{
 		params:      Params{"field": "somefield"},
 		expected:    map[string]interface{}{"somefield": map[string]interface{}{"$exists": true}},
 	},
+	{
+		name:        "dates and ObjectIds inside arrays",
+		queryString: `{"$or": [{"a": {"$gt": {"$date": "2020-01-01T00:00:00Z"}}}, {"b": {"$in": ["{{.id}}", [{"$date": "2020-01-02T00:00:00Z"}]]}}]}`,
+		params:      Params{"id": "111111111111111111111111"},
+		expected: map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"a": map[string]interface{}{"$gt": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			map[string]interface{}{"b": map[string]interface{}{"$in": []interface{}{
+				bson.ObjectIdHex("111111111111111111111111"),
+				[]interface{}{time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+			}}},
+		}},
+	},
 	{
 		name:          "invalid json (missing quotes)",
 		queryString:   `{id: 5}`,
@@ -215,3 +228,11 @@ func TestParseTemplatedJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTemplatedJSONDateFunctionsInArrays(t *testing.T) {
+	query, err := ParseTemplatedJSON(`{"$or": [{"a": {"$gt": {{daysAgo 7}}}}, {"b": 1}]}`, Params{})
+	assert.NoError(t, err)
+	or := query["$or"].([]interface{})
+	assert.IsType(t, time.Time{}, or[0].(map[string]interface{})["a"].(map[string]interface{})["$gt"])
+	assert.Equal(t, map[string]interface{}{"b": float64(1)}, or[1])
+}
@@ -0,0 +1,69 @@
+package moredis
+
+import (
+	"fmt"
+	"sync"
+	"text/template"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Entry is a key/value pair written to a map.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Transform computes the entries that a document adds to a map, for mappings that are too
+// complex for templates.  It can return any number of entries; entries with an empty key
+// are skipped.  The document is shared with the collection's other maps, so a Transform
+// must not modify it.
+type Transform func(doc bson.M) ([]Entry, error)
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]Transform{}
+)
+
+// RegisterTransform makes a Transform available to map configs as `transform: <name>`.
+// It is meant to be called from init functions, and panics if name is empty or already
+// registered.
+func RegisterTransform(name string, fn Transform) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if name == "" || fn == nil {
+		panic("moredis: RegisterTransform requires a name and a transform")
+	}
+	if _, ok := transforms[name]; ok {
+		panic(fmt.Sprintf("moredis: transform %q is already registered", name))
+	}
+	transforms[name] = fn
+}
+
+// lookupTransform returns the Transform registered as name.
+func lookupTransform(name string) (Transform, error) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	fn, ok := transforms[name]
+	if !ok {
+		return nil, fmt.Errorf("no transform named %q is registered", name)
+	}
+	return fn, nil
+}
+
+// RegisterTemplateFuncs adds functions to those available in templates, alongside the
+// built in ones like toLower.  It is meant to be called from init functions, before any
+// templates are parsed, and panics if a function with the same name already exists.
+func RegisterTemplateFuncs(funcs template.FuncMap) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	for name := range funcs {
+		if _, ok := queryFuncMap[name]; ok {
+			panic(fmt.Sprintf("moredis: template function %q already exists", name))
+		}
+	}
+	for name, fn := range funcs {
+		funcMap[name] = fn
+		queryFuncMap[name] = fn
+	}
+}
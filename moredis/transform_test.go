@@ -0,0 +1,92 @@
+package moredis
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	// maps each of a document's phone numbers, stripped of punctuation, to its _id
+	RegisterTransform("testPhones", func(doc bson.M) ([]Entry, error) {
+		phones, _ := doc["phones"].([]interface{})
+		entries := []Entry{}
+		for _, phone := range phones {
+			digits := strings.Map(func(r rune) rune {
+				if r < '0' || r > '9' {
+					return -1
+				}
+				return r
+			}, toString(phone))
+			entries = append(entries, Entry{Key: digits, Value: toString(doc["_id"])})
+		}
+		return entries, nil
+	})
+	RegisterTransform("testFails", func(doc bson.M) ([]Entry, error) {
+		return nil, errors.New("transform failed")
+	})
+	RegisterTemplateFuncs(template.FuncMap{"testShout": func(s string) string { return strings.ToUpper(s) + "!" }})
+}
+
+func TestProcessQueryTransform(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "phones": []interface{}{"(555) 123-4567", "555.765.4321"}},
+		{"_id": "2", "phones": []interface{}{"--"}},
+		{"_id": "3"},
+	})
+	collection := CollectionConfig{
+		Maps: []MapConfig{{Transform: "testPhones", HashKey: "moredis:maps:1"}},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "5551234567", "1").Expect("ok")
+	redigomock.Command("HSET", "moredis:maps:1", "5557654321", "1").Expect("ok")
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.NoError(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Maps[0].EntriesWritten)
+	assert.Equal(t, map[string]int{"empty": 1, "no_entries": 1}, report.Maps[0].Skipped)
+
+	// transforms use every field, so no projection can be derived
+	_, ok := deriveProjection(collection)
+	assert.False(t, ok)
+}
+
+func TestProcessQueryTransformError(t *testing.T) {
+	collection := CollectionConfig{
+		Maps: []MapConfig{{Transform: "testFails", HashKey: "moredis:maps:1"}},
+	}
+	assert.NoError(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(NewRedisWriter(redigomock.NewConn()), NewMockIter([]bson.M{{"_id": "1"}}), collection.Maps)
+	assert.EqualError(t, err, "transform failed")
+	assert.Equal(t, "transform failed", report.Maps[0].Error)
+
+	collection = CollectionConfig{Maps: []MapConfig{{Transform: "nope"}}}
+	assert.EqualError(t, ParseTemplates(&collection), `no transform named "nope" is registered`)
+}
+
+func TestRegisterTransformDuplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterTransform("testPhones", func(doc bson.M) ([]Entry, error) { return nil, nil })
+	})
+}
+
+func TestRegisterTemplateFuncs(t *testing.T) {
+	out, err := ApplyTemplate("{{testShout .name}}", bson.M{"name": "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, "HI!", out)
+
+	// registered functions are also available to queries
+	query, err := ParseTemplatedJSON(`{"name": "{{testShout .name}}"}`, Params{"name": "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "HI!"}, query)
+
+	assert.Panics(t, func() {
+		RegisterTemplateFuncs(template.FuncMap{"toLower": strings.ToLower})
+	})
+}
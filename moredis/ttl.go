@@ -0,0 +1,99 @@
+package moredis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// parseTTL parses a map's ttl, a duration like "24h" of at least a second.  An empty ttl
+// parses as zero, for maps that don't expire.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %s", err)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("invalid ttl: %s is less than 1s", ttl)
+	}
+	return d, nil
+}
+
+// expiryTime parses the rendered expires template of an entry, which is either an RFC3339
+// date or a duration after now.  The second return value is false if the entry doesn't
+// expire, because the template rendered as empty or "<no value>".
+func expiryTime(rendered string, now time.Time) (time.Time, bool, error) {
+	rendered = strings.TrimSpace(rendered)
+	if rendered == "" || rendered == noValue {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, rendered); err == nil {
+		return t, true, nil
+	}
+	if d, err := time.ParseDuration(rendered); err == nil {
+		return now.Add(d), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid expires %q, must be an RFC3339 date or a duration", rendered)
+}
+
+// epochMillis returns t as milliseconds since the unix epoch, for PEXPIREAT and HPEXPIREAT.
+func epochMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// hashFieldTTLSupported reports whether redis can expire the fields of a hash, which
+// needs redis 7.4.  Servers too old to have COMMAND INFO don't support it either.
+func hashFieldTTLSupported(conn redis.Conn) bool {
+	info, err := redis.Values(conn.Do("COMMAND", "INFO", "HPEXPIREAT"))
+	return err == nil && len(info) == 1 && info[0] != nil
+}
+
+// hashFieldExpiries returns when each of fields of hashKey expires, as the zero time for
+// fields that don't expire.  Fields the hash no longer has expired at the unix epoch.
+func hashFieldExpiries(conn redis.Conn, hashKey string, fields []string) ([]time.Time, error) {
+	args := []interface{}{hashKey, "FIELDS", len(fields)}
+	for _, field := range fields {
+		args = append(args, field)
+	}
+	millis, err := redis.Int64s(conn.Do("HPEXPIRETIME", args...))
+	if err != nil {
+		return nil, err
+	}
+	expiries := make([]time.Time, len(millis))
+	for ix, ms := range millis {
+		switch ms {
+		case -1:
+		case -2:
+			expiries[ix] = time.Unix(0, 0)
+		default:
+			expiries[ix] = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	return expiries, nil
+}
+
+// expireMap sets a map's ttl on its hash, its metadata and its name, once the name refers
+// to the hash.  Each build sets the ttl afresh, so the map only expires if it stops being
+// built.
+func expireMap(conn redis.Conn, mapName string, mapConfig MapConfig) error {
+	ttl, err := parseTTL(mapConfig.TTL)
+	if err != nil || ttl == 0 {
+		return err
+	}
+	seconds := int64(ttl / time.Second)
+	keys := []string{mapConfig.HashKey, mapName}
+	if mapConfig.Metadata != nil {
+		keys = append(keys, MetadataKey(mapConfig.HashKey))
+	}
+	for _, key := range keys {
+		if _, err := conn.Do("EXPIRE", key, seconds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package moredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseTTL(t *testing.T) {
+	ttl, err := parseTTL("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	ttl, err = parseTTL("24h")
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, ttl)
+	_, err = parseTTL("500ms")
+	assert.EqualError(t, err, "invalid ttl: 500ms is less than 1s")
+	_, err = parseTTL("tomorrow")
+	assert.EqualError(t, err, `invalid ttl: time: invalid duration "tomorrow"`)
+}
+
+func TestExpiryTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, spec := range []struct {
+		rendered string
+		expected time.Time
+		expires  bool
+		err      string
+	}{
+		{rendered: "", expires: false},
+		{rendered: "<no value>", expires: false},
+		{rendered: "2021-06-01T12:00:00Z", expected: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), expires: true},
+		{rendered: " 90m ", expected: now.Add(90 * time.Minute), expires: true},
+		{rendered: "soon", err: `invalid expires "soon", must be an RFC3339 date or a duration`},
+	} {
+		expireAt, expires, err := expiryTime(spec.rendered, now)
+		if spec.err != "" {
+			assert.EqualError(t, err, spec.err, spec.rendered)
+			continue
+		}
+		assert.NoError(t, err, spec.rendered)
+		assert.Equal(t, spec.expires, expires, spec.rendered)
+		assert.True(t, spec.expected.Equal(expireAt), spec.rendered)
+	}
+}
+
+func TestHashFieldTTLSupported(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("COMMAND", "INFO", "HPEXPIREAT").Expect([]interface{}{[]interface{}{[]byte("hpexpireat")}})
+	assert.True(t, hashFieldTTLSupported(redigomock.NewConn()))
+
+	redigomock.Clear()
+	redigomock.Command("COMMAND", "INFO", "HPEXPIREAT").Expect([]interface{}{nil})
+	assert.False(t, hashFieldTTLSupported(redigomock.NewConn()))
+
+	redigomock.Clear()
+	redigomock.Command("COMMAND", "INFO", "HPEXPIREAT").ExpectError(redis.Error("ERR unknown command 'COMMAND'"))
+	assert.False(t, hashFieldTTLSupported(redigomock.NewConn()))
+}
+
+func TestProcessQueryExpires(t *testing.T) {
+	iter := NewMockIter([]bson.M{
+		{"_id": "1", "email": "a@x.com", "expires_at": time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"_id": "2", "email": "b@x.com", "expires_at": time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"_id": "3", "email": "c@x.com"},
+	})
+	collection := CollectionConfig{
+		Maps: []MapConfig{
+			{Key: "{{._id}}", Value: "{{.email}}", Expires: "{{rfc3339 .expires_at}}", HashKey: "moredis:maps:1"},
+			{Key: "{{._id}}", Fields: map[string]string{"email": "{{.email}}"}, Expires: "{{rfc3339 .expires_at}}",
+				TTL: "1h", HashKey: "moredis:maps:2"},
+		},
+	}
+	redigomock.Clear()
+	redigomock.Command("HSET", "moredis:maps:1", "1", "a@x.com").Expect(int64(1))
+	redigomock.Command("HSET", "moredis:maps:1", "3", "c@x.com").Expect(int64(1))
+	redigomock.Command("HPEXPIREAT", "moredis:maps:1", int64(4102444800000), "FIELDS", 1, "1").Expect([]interface{}{int64(1)})
+	redigomock.Command("HMSET", "moredis:maps:2:entity:1", "email", "a@x.com").Expect("OK")
+	redigomock.Command("HMSET", "moredis:maps:2:entity:3", "email", "c@x.com").Expect("OK")
+	redigomock.Command("PEXPIREAT", "moredis:maps:2:entity:1", int64(4102444800000)).Expect(int64(1))
+	// entities without an expiry expire after the map's ttl
+	redigomock.Command("PEXPIRE", "moredis:maps:2:entity:3", int64(3600000)).Expect(int64(1))
+	writer := NewRedisWriter(redigomock.NewConn())
+	assert.Nil(t, ParseTemplates(&collection))
+	report, err := ProcessQuery(writer, iter, collection.Maps)
+	assert.Nil(t, err)
+	for _, mapReport := range report.Maps {
+		assert.Equal(t, 2, mapReport.EntriesWritten)
+		assert.Equal(t, map[string]int{"expired": 1}, mapReport.Skipped)
+	}
+
+	// expires can't be used with aggregates, which are written after every document
+	collection = CollectionConfig{Maps: []MapConfig{{Key: "{{.school}}", Aggregate: AggregateCount, Expires: "1h"}}}
+	assert.EqualError(t, ParseTemplates(&collection), "expires can't be used with aggregate")
+}
+
+func TestUpdateRedisMapReferenceTTL(t *testing.T) {
+	redigomock.Clear()
+	redigomock.Command("GETSET", "users", "moredis:maps:2").ExpectError(redis.ErrNil)
+	redigomock.Command("EXPIRE", "moredis:maps:2", int64(86400)).Expect(int64(1))
+	redigomock.Command("EXPIRE", "users", int64(86400)).Expect(int64(1))
+	rmap := MapConfig{Name: "users", HashKey: "moredis:maps:2", TTL: "24h"}
+	assert.NoError(t, UpdateRedisMapReference(redigomock.NewConn(), Params{}, rmap))
+
+	redigomock.Clear()
+	redigomock.Command("GETSET", "users", "moredis:maps:2").ExpectError(redis.ErrNil)
+	redigomock.GenericCommand("EXPIRE").ExpectError(redis.Error("ERR boom"))
+	assert.EqualError(t, UpdateRedisMapReference(redigomock.NewConn(), Params{}, rmap), "ERR boom")
+}
@@ -0,0 +1,603 @@
+package moredis
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem with a config file found by ValidateConfig.
+type ValidationError struct {
+	File string
+	// Line is the line of the config file the problem is on, or 0 if it isn't known.
+	Line int
+	// Cache, Collection and Map are the indexes of the cache (under caches), collection and
+	// map the problem is in, or -1 if it isn't in one.
+	Cache      int
+	Collection int
+	Map        int
+	Message    string
+}
+
+// Error formats the error as <file>:<line>: caches[<ix>].collections[<ix>].maps[<ix>]: <message>
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if location := configLocation(e.Cache, e.Collection, e.Map); location != "" {
+		b.WriteString(": " + location)
+	}
+	b.WriteString(": " + e.Message)
+	return b.String()
+}
+
+// configLocation describes where a cache, collection or map is in a config file.
+func configLocation(cix, collIx, mix int) string {
+	parts := []string{}
+	if cix >= 0 {
+		parts = append(parts, fmt.Sprintf("caches[%d]", cix))
+	}
+	if collIx >= 0 {
+		parts = append(parts, fmt.Sprintf("collections[%d]", collIx))
+	}
+	if mix >= 0 {
+		parts = append(parts, fmt.Sprintf("maps[%d]", mix))
+	}
+	return strings.Join(parts, ".")
+}
+
+// ValidateConfig checks the config file at path, and the files it includes, for problems
+// that would otherwise only be found when building the cache: invalid YAML, unknown fields,
+// missing required fields, template syntax errors, queries and projections that don't
+// render to JSON objects with params, params that are used but not given, and duplicate
+// cache and map names.  An error is only returned if the file can't be read.
+func ValidateConfig(path string, params Params) ([]ValidationError, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return validateConfig(path, raw, params), nil
+}
+
+// yamlErrorLine matches the line numbers in errors from the yaml package.
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+
+// configSource is a config file being validated.
+type configSource struct {
+	path string
+	root *yaml.Node
+	file ConfigFile
+}
+
+// validator collects the problems with a config.
+type validator struct {
+	params    Params
+	errors    []ValidationError
+	files     []*configSource
+	templates map[string]string
+	// cacheNames and mapNames map names to where they were first seen
+	cacheNames map[string]string
+	mapNames   map[string]string
+
+	// the file and cache being validated, and the path to the cache in the file
+	file   *configSource
+	cache  int
+	prefix []interface{}
+}
+
+func validateConfig(path string, raw []byte, params Params) []ValidationError {
+	v := &validator{
+		params:     params,
+		templates:  map[string]string{},
+		cacheNames: map[string]string{},
+		mapNames:   map[string]string{},
+		cache:      -1,
+	}
+	seen := map[string]bool{}
+	if abs, err := filepath.Abs(path); err == nil {
+		seen[abs] = true
+	}
+	v.read(path, raw, seen)
+	if len(v.errors) > 0 && len(v.files) == 0 {
+		return v.errors
+	}
+
+	// named templates from every file can be used by every cache, so collect them first
+	for _, src := range v.files {
+		v.setFile(src, -1, nil)
+		names := make([]string, 0, len(src.file.Templates))
+		for name := range src.file.Templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			text := src.file.Templates[name]
+			at := []interface{}{"templates", name}
+			if existing, ok := v.templates[name]; ok && existing != text {
+				v.errorf(at, -1, -1, "template %q is already defined differently", name)
+				continue
+			}
+			v.templates[name] = text
+			if _, err := template.New(name).Funcs(queryFuncMap).Parse(text); err != nil {
+				v.errorf(at, -1, -1, "invalid template %q: %s", name, err)
+			}
+		}
+	}
+
+	caches := 0
+	for _, src := range v.files {
+		if src.file.Name != "" || len(src.file.Collections) > 0 {
+			v.setFile(src, -1, nil)
+			v.validateCache(src.file.Config)
+			caches++
+		}
+		for cix, cache := range src.file.Caches {
+			v.setFile(src, cix, []interface{}{"caches", cix})
+			v.validateCache(cache)
+			caches++
+		}
+	}
+	if caches == 0 && len(v.files) > 0 {
+		v.setFile(v.files[0], -1, nil)
+		v.errorf(nil, -1, -1, "no caches")
+	}
+	return v.errors
+}
+
+// read parses a config file, recording any problems with its YAML, then reads the files it
+// includes that haven't been seen yet.
+func (v *validator) read(path string, raw []byte, seen map[string]bool) {
+	src := &configSource{path: path}
+	v.setFile(src, -1, nil)
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		v.yamlError(err.Error())
+		return
+	}
+	if len(root.Content) == 0 {
+		v.errorf(nil, -1, -1, "config is empty")
+		return
+	}
+	src.root = root.Content[0]
+
+	// decode the file as written to find unknown fields, then with values interpolated
+	var strict ConfigFile
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&strict); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			v.yamlError(err.Error())
+			return
+		}
+		// the rest of the file is still decoded, so carry on checking it
+		for _, msg := range typeErr.Errors {
+			v.yamlError(msg)
+		}
+	}
+	interpolateNode(&root, func(node *yaml.Node, err error) {
+		v.errors = append(v.errors, ValidationError{
+			File: path, Line: node.Line, Cache: -1, Collection: -1, Map: -1, Message: err.Error(),
+		})
+	})
+	// type errors were reported by the strict decode
+	root.Decode(&src.file)
+	v.files = append(v.files, src)
+
+	for ix, pattern := range src.file.Include {
+		includes, err := expandInclude(path, pattern)
+		if err != nil {
+			v.setFile(src, -1, nil)
+			v.errorf([]interface{}{"include", ix}, -1, -1, "%s", err)
+			continue
+		}
+		for _, include := range includes {
+			abs, err := filepath.Abs(include)
+			if err != nil || seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			raw, err := ioutil.ReadFile(include)
+			if err != nil {
+				v.setFile(src, -1, nil)
+				v.errorf([]interface{}{"include", ix}, -1, -1, "%s", err)
+				continue
+			}
+			v.read(include, raw, seen)
+		}
+	}
+}
+
+// setFile sets the file and cache that errors are recorded for.
+func (v *validator) setFile(src *configSource, cix int, prefix []interface{}) {
+	v.file = src
+	v.cache = cix
+	v.prefix = prefix
+}
+
+func (v *validator) validateCache(conf Config) {
+	if conf.Name != "" {
+		if first, ok := v.cacheNames[conf.Name]; ok {
+			v.errorf([]interface{}{"name"}, -1, -1, "duplicate cache name %q, also used by %s", conf.Name, first)
+		} else {
+			v.cacheNames[conf.Name] = v.location(-1, -1)
+		}
+	}
+	if len(conf.Collections) == 0 {
+		v.errorf([]interface{}{"collections"}, -1, -1, "no collections")
+	}
+	for cix, collection := range conf.Collections {
+		v.validateCollection(cix, collection)
+	}
+	if _, _, err := orderCollections(conf.Collections, v.params); err != nil {
+		v.errorf([]interface{}{"collections"}, -1, -1, "%s", err)
+	}
+}
+
+func (v *validator) validateCollection(cix int, collection CollectionConfig) {
+	path := []interface{}{"collections", cix}
+	if collection.Derive != nil {
+		v.validateDerive(cix, *collection.Derive)
+		if collection.Collection != "" || collection.Query != "" || collection.Projection != "" {
+			v.errorf(append(path, "derive"), cix, -1, "derive can't be used with collection, query or projection")
+		}
+	} else {
+		if collection.Collection == "" {
+			v.errorf(path, cix, -1, "collection is required")
+		}
+		if collection.Query == "" {
+			v.errorf(path, cix, -1, "query is required")
+		} else {
+			v.validateJSON(append(path, "query"), cix, "query", collection.Query)
+		}
+		if collection.Projection != "" {
+			v.validateJSON(append(path, "projection"), cix, "projection", collection.Projection)
+		}
+	}
+	if len(collection.Maps) == 0 {
+		v.errorf(path, cix, -1, "no maps")
+	}
+	names := map[string]bool{}
+	for lix, lookup := range collection.Lookups {
+		at := []interface{}{"collections", cix, "lookups", lix}
+		if lookup.As == "" {
+			v.errorf(at, cix, -1, "lookup as is required")
+		} else if names[lookup.As] {
+			v.errorf(append(at, "as"), cix, -1, "lookup %q is defined more than once", lookup.As)
+		}
+		names[lookup.As] = true
+		if lookup.LocalField == "" {
+			v.errorf(at, cix, -1, "lookup local_field is required")
+		}
+		switch {
+		case lookup.Collection == "" && lookup.Map == "":
+			v.errorf(at, cix, -1, "lookup collection or map is required")
+		case lookup.Collection != "" && lookup.Map != "":
+			v.errorf(append(at, "map"), cix, -1, "lookup collection and map can't both be set")
+		case lookup.Map != "":
+			if lookup.ForeignField != "" || lookup.Projection != "" {
+				v.errorf(append(at, "map"), cix, -1, "lookup foreign_field and projection can't be used with map")
+			}
+			if tmpl, ok := v.parse(append(at, "map"), cix, -1, "map", lookup.Map, funcMap); ok {
+				v.checkParams(append(at, "map"), cix, -1, "map", tmpl)
+			}
+		case lookup.Projection != "":
+			v.validateJSON(append(at, "projection"), cix, "projection", lookup.Projection)
+		}
+	}
+	for fix, field := range collection.Computed {
+		at := []interface{}{"collections", cix, "computed", fix}
+		switch {
+		case field.Name == "":
+			v.errorf(at, cix, -1, "computed field name is required")
+		case strings.Contains(field.Name, "."):
+			v.errorf(append(at, "name"), cix, -1, "computed field name %q can't contain '.'", field.Name)
+		case names[field.Name]:
+			v.errorf(append(at, "name"), cix, -1, "computed field %q is defined more than once", field.Name)
+		}
+		names[field.Name] = true
+		if field.Expr == "" {
+			v.errorf(at, cix, -1, "computed field expr is required")
+		} else if _, err := ParseExpression(field.Expr); err != nil {
+			v.errorf(append(at, "expr"), cix, -1, "invalid expr: %s", err)
+		}
+	}
+	for mix, rmap := range collection.Maps {
+		v.validateMap(cix, mix, rmap)
+	}
+}
+
+func (v *validator) validateDerive(cix int, derive DeriveConfig) {
+	path := []interface{}{"collections", cix, "derive"}
+	if derive.From == "" {
+		v.errorf(path, cix, -1, "derive from is required")
+	} else if tmpl, ok := v.parse(append(path, "from"), cix, -1, "from", derive.From, funcMap); ok {
+		v.checkParams(append(path, "from"), cix, -1, "from", tmpl)
+	}
+	for six, step := range derive.Steps {
+		at := []interface{}{"collections", cix, "derive", "steps", six}
+		if err := step.validate(); err != nil {
+			v.errorf(at, cix, -1, "%s", err)
+			continue
+		}
+		if step.Compose != "" {
+			if tmpl, ok := v.parse(append(at, "compose"), cix, -1, "compose", step.Compose, funcMap); ok {
+				v.checkParams(append(at, "compose"), cix, -1, "compose", tmpl)
+			}
+		}
+		if step.Filter != "" {
+			if _, err := ParseExpression(step.Filter); err != nil {
+				v.errorf(append(at, "filter"), cix, -1, "invalid filter: %s", err)
+			}
+		}
+	}
+}
+
+func (v *validator) validateMap(cix, mix int, rmap MapConfig) {
+	path := []interface{}{"collections", cix, "maps", mix}
+	at := func(field string) []interface{} {
+		return append(path[:len(path):len(path)], field)
+	}
+
+	if rmap.Name == "" {
+		v.errorf(path, cix, mix, "name is required")
+	} else if tmpl, ok := v.parse(at("name"), cix, mix, "name", rmap.Name, funcMap); ok {
+		if v.checkParams(at("name"), cix, mix, "name", tmpl) {
+			v.checkDuplicateName(at("name"), cix, mix, tmpl)
+		}
+	}
+
+	switch {
+	case rmap.Transform != "" && rmap.Script != "":
+		v.errorf(at("script"), cix, mix, "transform and script can't both be set")
+	case rmap.Transform != "":
+		if _, err := lookupTransform(rmap.Transform); err != nil {
+			v.errorf(at("transform"), cix, mix, "%s", err)
+		}
+		if rmap.Key != "" || rmap.Value != "" || rmap.ValueJSON != nil || len(rmap.Fields) > 0 {
+			v.errorf(at("transform"), cix, mix, "transform can't be used with key, val, val_json or fields")
+		}
+	case rmap.Script != "":
+		if _, err := compileScript("script", rmap.Script, rmap.ScriptTimeout); err != nil {
+			v.errorf(at("script"), cix, mix, "invalid script: %s", err)
+		}
+		if rmap.Key != "" || rmap.Value != "" || rmap.ValueJSON != nil || len(rmap.Fields) > 0 {
+			v.errorf(at("script"), cix, mix, "script can't be used with key, val, val_json or fields")
+		}
+	case len(rmap.Fields) > 0:
+		if rmap.Key == "" {
+			v.errorf(path, cix, mix, "key is required")
+		} else {
+			v.parse(at("key"), cix, mix, "key", rmap.Key, funcMap)
+		}
+		if rmap.Value != "" || rmap.ValueJSON != nil || rmap.Aggregate != "" {
+			v.errorf(at("fields"), cix, mix, "fields can't be used with val, val_json or aggregate")
+		}
+		names := make([]string, 0, len(rmap.Fields))
+		for name := range rmap.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v.parse(append(at("fields"), name), cix, mix, "fields."+name, rmap.Fields[name], funcMap)
+		}
+	default:
+		if rmap.Key == "" {
+			v.errorf(path, cix, mix, "key is required")
+		} else {
+			v.parse(at("key"), cix, mix, "key", rmap.Key, funcMap)
+		}
+		switch {
+		case rmap.Value == "" && rmap.ValueJSON == nil && rmap.Aggregate == AggregateCount:
+		case rmap.Value == "" && rmap.ValueJSON == nil:
+			v.errorf(path, cix, mix, "val or val_json is required")
+		case rmap.Value != "" && rmap.ValueJSON != nil:
+			v.errorf(at("val_json"), cix, mix, "val and val_json can't both be set")
+		case rmap.Value != "":
+			v.parse(at("val"), cix, mix, "val", rmap.Value, funcMap)
+		}
+	}
+	if rmap.When != "" {
+		v.parse(at("when"), cix, mix, "when", rmap.When, funcMap)
+	}
+	if err := checkAggregate(rmap.Aggregate); err != nil {
+		v.errorf(at("aggregate"), cix, mix, "%s", err)
+	} else if rmap.Aggregate != "" && rmap.ValueJSON != nil {
+		v.errorf(at("aggregate"), cix, mix, "aggregate can't be used with val_json")
+	}
+	if err := checkMissingMode(rmap.Missing); err != nil {
+		v.errorf(at("missing"), cix, mix, "%s", err)
+	}
+	if _, err := parseTTL(rmap.TTL); err != nil {
+		v.errorf(at("ttl"), cix, mix, "%s", err)
+	}
+	if rmap.Expires != "" {
+		if rmap.Transform != "" || rmap.Script != "" || rmap.Aggregate != "" {
+			v.errorf(at("expires"), cix, mix, "expires can't be used with transform, script or aggregate")
+		} else {
+			v.parse(at("expires"), cix, mix, "expires", rmap.Expires, funcMap)
+		}
+	}
+}
+
+// validateJSON checks that a query or projection template parses, and renders to a JSON
+// object with the params.
+func (v *validator) validateJSON(path []interface{}, cix int, name, text string) {
+	tmpl, ok := v.parse(path, cix, -1, name, text, queryFuncMap)
+	if !ok || !v.checkParams(path, cix, -1, name, tmpl) {
+		return
+	}
+	if _, err := parseTemplatedJSON(text, v.params, v.templates); err != nil {
+		v.errorf(path, cix, -1, "%s does not render to a JSON object: %s", name, err)
+	}
+}
+
+// parse parses a template, recording an error if it is invalid.
+func (v *validator) parse(path []interface{}, cix, mix int, name, text string, funcs template.FuncMap) (*template.Template, bool) {
+	tmpl, err := newTemplate(name, text, funcs, v.templates)
+	if err != nil {
+		v.errorf(path, cix, mix, "invalid %s template: %s", name, err)
+		return nil, false
+	}
+	if undefined := undefinedTemplates(tmpl); len(undefined) > 0 {
+		for _, invoked := range undefined {
+			v.errorf(path, cix, mix, "%s template invokes template %q, which is not defined", name, invoked)
+		}
+		return nil, false
+	}
+	return tmpl, true
+}
+
+// undefinedTemplates returns the names of the templates that tmpl invokes but aren't defined.
+func undefinedTemplates(tmpl *template.Template) []string {
+	undefined := []string{}
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, n := range node.Nodes {
+				walk(n)
+			}
+		case *parse.IfNode:
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.RangeNode:
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.WithNode:
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.TemplateNode:
+			if tmpl.Lookup(node.Name) == nil {
+				undefined = append(undefined, node.Name)
+			}
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	return undefined
+}
+
+// checkParams records an error for each param that a template uses but isn't set.  It
+// returns false if there were any.
+func (v *validator) checkParams(path []interface{}, cix, mix int, name string, tmpl *template.Template) bool {
+	fields := fieldSet{}
+	usedFields(tmpl, &fields)
+	ok := true
+	for _, field := range fields.reduced() {
+		param := strings.Split(field, ".")[0]
+		if _, set := v.params[param]; !set {
+			v.errorf(path, cix, mix, "%s uses param %q, which is not set", name, param)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// checkDuplicateName records an error if a map name renders the same as an earlier one.
+func (v *validator) checkDuplicateName(path []interface{}, cix, mix int, tmpl *template.Template) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, v.params.Bson()); err != nil {
+		v.errorf(path, cix, mix, "invalid name template: %s", err)
+		return
+	}
+	name := b.String()
+	if first, ok := v.mapNames[name]; ok {
+		v.errorf(path, cix, mix, "duplicate map name %q, also used by %s", name, first)
+		return
+	}
+	v.mapNames[name] = v.location(cix, mix)
+}
+
+// location describes where a collection or map of the current cache is, for messages about
+// duplicates.  The file is included if there is more than one.
+func (v *validator) location(cix, mix int) string {
+	location := configLocation(v.cache, cix, mix)
+	if len(v.files) > 1 {
+		if location == "" {
+			return v.file.path
+		}
+		return v.file.path + ": " + location
+	}
+	if location == "" {
+		return "the top level"
+	}
+	return location
+}
+
+func (v *validator) errorf(path []interface{}, cix, mix int, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{
+		File:       v.file.path,
+		Line:       v.line(append(v.prefix[:len(v.prefix):len(v.prefix)], path...)),
+		Cache:      v.cache,
+		Collection: cix,
+		Map:        mix,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// yamlError records an error from the yaml package, moving its line number out of the message.
+func (v *validator) yamlError(msg string) {
+	err := ValidationError{File: v.file.path, Cache: -1, Collection: -1, Map: -1, Message: msg}
+	if match := yamlErrorLine.FindStringSubmatch(msg); match != nil {
+		err.Line, _ = strconv.Atoi(match[1])
+		err.Message = msg[len(match[0]):]
+	}
+	v.errors = append(v.errors, err)
+}
+
+// line returns the line of the node at a path of mapping keys and sequence indexes.  If
+// there is no node at the path, it returns the line of the deepest node on the path.
+func (v *validator) line(path []interface{}) int {
+	node := v.file.root
+	if node == nil {
+		return 0
+	}
+	for _, step := range path {
+		next := childNode(node, step)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// childNode returns the value for a key in a mapping node or the element at an index in a
+// sequence node, or nil if there is none.
+func childNode(node *yaml.Node, step interface{}) *yaml.Node {
+	switch step := step.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for ix := 0; ix+1 < len(node.Content); ix += 2 {
+			if node.Content[ix].Value == step {
+				return node.Content[ix+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && step < len(node.Content) {
+			return node.Content[step]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package moredis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validConfig = `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{"group": "{{.group}}"}'
+    maps:
+      - name: 'users:email'
+        key: '{{toLower .email}}'
+        val: '{{toString ._id}}'
+`
+
+type validateConfigTestSpec struct {
+	name     string
+	config   string
+	params   Params
+	expected []string
+}
+
+var validateConfigTests = []validateConfigTestSpec{
+	{
+		name:     "valid",
+		config:   validConfig,
+		params:   Params{"group": "a"},
+		expected: []string{},
+	},
+	{
+		name:     "missing param",
+		config:   validConfig,
+		params:   Params{},
+		expected: []string{`config.yml:4: collections[0]: query uses param "group", which is not set`},
+	},
+	{
+		name:     "invalid yaml",
+		config:   "name: 'test'\ncollections: [\n",
+		expected: []string{"config.yml:2: did not find expected node content"},
+	},
+	{
+		name: "unknown field",
+		config: `collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'users:email'
+        key: '{{.email}}'
+        value: '{{._id}}'
+`,
+		expected: []string{
+			"config.yml:7: field value not found in type moredis.MapConfig",
+			"config.yml:5: collections[0].maps[0]: val or val_json is required",
+		},
+	},
+	{
+		name: "template errors",
+		config: `collections:
+  - collection: 'users'
+    query: '{"a": {{.a | nope}}}'
+    projection: '{"a": 1'
+    maps:
+      - name: 'users:email'
+        key: '{{.email'
+        val: '{{nope ._id}}'
+        missing: 'sometimes'
+`,
+		expected: []string{
+			`config.yml:3: collections[0]: invalid query template: template: query:1: function "nope" not defined`,
+			"config.yml:4: collections[0]: projection does not render to a JSON object: unexpected end of JSON input",
+			"config.yml:7: collections[0].maps[0]: invalid key template: template: key:1: unclosed action",
+			`config.yml:8: collections[0].maps[0]: invalid val template: template: val:1: function "nope" not defined`,
+			`config.yml:9: collections[0].maps[0]: unknown missing mode "sometimes", must be one of error, skip, empty or default`,
+		},
+	},
+	{
+		name: "duplicate map names",
+		config: `collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'users:{{.env}}'
+        key: '{{.email}}'
+        val: '{{._id}}'
+  - collection: 'accounts'
+    query: '{}'
+    maps:
+      - name: 'users:prod'
+        key: '{{.email}}'
+        val_json: {}
+`,
+		params: Params{"env": "prod"},
+		expected: []string{
+			`config.yml:11: collections[1].maps[0]: duplicate map name "users:prod", also used by collections[0].maps[0]`,
+		},
+	},
+	{
+		name: "missing fields",
+		config: `collections:
+  - maps:
+      - val: '1'
+`,
+		expected: []string{
+			"config.yml:2: collections[0]: collection is required",
+			"config.yml:2: collections[0]: query is required",
+			"config.yml:3: collections[0].maps[0]: name is required",
+			"config.yml:3: collections[0].maps[0]: key is required",
+		},
+	},
+	{
+		name: "unset environment variable",
+		config: `collections:
+  - collection: 'users'
+    query: '{"group": "${MOREDIS_TEST_UNSET}"}'
+    maps:
+      - name: 'users:email'
+        key: '{{.email}}'
+        val: '{{._id}}'
+`,
+		expected: []string{"config.yml:3: environment variable MOREDIS_TEST_UNSET is not set"},
+	},
+	{
+		name: "unknown transform",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'users:phone'
+        transform: 'nope'
+        key: '{{.phone}}'
+`,
+		expected: []string{
+			`config.yml:7: collections[0].maps[0]: no transform named "nope" is registered`,
+			"config.yml:7: collections[0].maps[0]: transform can't be used with key, val, val_json or fields",
+		},
+	},
+	{
+		name: "computed fields",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    computed:
+      - name: 'full_name'
+        expr: 'first +'
+      - name: 'full_name'
+        expr: 'last'
+      - name: 'a.b'
+    maps:
+      - name: 'users:name'
+        key: '{{.full_name}}'
+        val: '{{._id}}'
+`,
+		expected: []string{
+			"config.yml:7: collections[0]: invalid expr: unexpected end of expression at column 8",
+			`config.yml:8: collections[0]: computed field "full_name" is defined more than once`,
+			`config.yml:10: collections[0]: computed field name "a.b" can't contain '.'`,
+			"config.yml:10: collections[0]: computed field expr is required",
+		},
+	},
+	{
+		name: "lookups",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    lookups:
+      - as: 'school'
+        local_field: 'school_id'
+      - as: 'plan'
+        local_field: 'school_id'
+        collection: 'plans'
+        map: 'plans:{{.env}}'
+      - as: 'district'
+        map: 'districts:name'
+        foreign_field: 'name'
+    maps:
+      - name: 'users:school'
+        key: '{{.email}}'
+        val: '{{.school.name}}'
+  - collection: 'districts'
+    query: '{}'
+    lookups:
+      - as: 'user'
+        local_field: 'user_id'
+        map: 'users:school'
+    maps:
+      - name: 'districts:name'
+        key: '{{._id}}'
+        val: '{{.name}}'
+`,
+		expected: []string{
+			"config.yml:6: collections[0]: lookup collection or map is required",
+			"config.yml:11: collections[0]: lookup collection and map can't both be set",
+			"config.yml:12: collections[0]: lookup local_field is required",
+			"config.yml:13: collections[0]: lookup foreign_field and projection can't be used with map",
+			"config.yml:3: collections users, districts read each other's maps in a cycle",
+		},
+	},
+	{
+		name: "derived maps",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    derive:
+      from: 'users:email'
+      steps:
+        - invert: true
+          compose: 'users:name'
+        - filter: 'val =='
+        - compose: 'users:name'
+    maps:
+      - name: 'users:id'
+        key: '{{.key}}'
+        val: '{{.val}}'
+  - derive: {}
+    maps:
+      - name: 'users:other'
+        key: '{{.key}}'
+        val: '{{.val}}'
+`,
+		expected: []string{
+			"config.yml:7: collections[0]: each step must set exactly one of invert, compose or filter",
+			"config.yml:9: collections[0]: invalid filter: unexpected end of expression at column 7",
+			"config.yml:5: collections[0]: derive can't be used with collection, query or projection",
+			"config.yml:15: collections[1]: derive from is required",
+		},
+	},
+	{
+		name: "aggregates",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'schools:active_users'
+        key: '{{.school_id}}'
+        aggregate: 'count'
+      - name: 'schools:logins'
+        key: '{{.school_id}}'
+        val: '{{.logins}}'
+        aggregate: 'avg'
+      - name: 'schools:users'
+        key: '{{.school_id}}'
+        val_json: {}
+        aggregate: 'max'
+`,
+		expected: []string{
+			`config.yml:12: collections[0].maps[1]: unknown aggregate "avg", must be one of count, sum, min, max, distinct_count`,
+			"config.yml:16: collections[0].maps[2]: aggregate can't be used with val_json",
+		},
+	},
+	{
+		name: "entity maps",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'user'
+        key: '{{._id}}'
+        fields:
+          email: '{{.email}}'
+          name: '{{.name'
+      - name: 'user:totals'
+        key: '{{._id}}'
+        aggregate: 'count'
+        fields:
+          email: '{{.email}}'
+`,
+		expected: []string{
+			"config.yml:10: collections[0].maps[0]: invalid fields.name template: template: fields.name:1: unclosed action",
+			"config.yml:15: collections[0].maps[1]: fields can't be used with val, val_json or aggregate",
+		},
+	},
+	{
+		name: "ttls",
+		config: `name: 'test'
+collections:
+  - collection: 'users'
+    query: '{}'
+    maps:
+      - name: 'users'
+        key: '{{._id}}'
+        val: '{{.email}}'
+        ttl: '24h'
+        expires: '{{rfc3339 .expires_at}}'
+      - name: 'users:short'
+        key: '{{._id}}'
+        val: '{{.email}}'
+        ttl: '10ms'
+        expires: '{{.expires_at'
+      - name: 'users:count'
+        key: '{{.school}}'
+        aggregate: 'count'
+        ttl: 'a day'
+        expires: '1h'
+`,
+		expected: []string{
+			"config.yml:14: collections[0].maps[1]: invalid ttl: 10ms is less than 1s",
+			"config.yml:15: collections[0].maps[1]: invalid expires template: template: expires:1: unclosed action",
+			"config.yml:19: collections[0].maps[2]: invalid ttl: time: invalid duration \"a day\"",
+			"config.yml:20: collections[0].maps[2]: expires can't be used with transform, script or aggregate",
+		},
+	},
+	{
+		name:     "empty",
+		config:   "",
+		expected: []string{"config.yml: config is empty"},
+	},
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, spec := range validateConfigTests {
+		errs := validateConfig("config.yml", []byte(spec.config), spec.params)
+		msgs := []string{}
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		assert.Equal(t, spec.expected, msgs, spec.name)
+	}
+}
+
+func TestValidateConfigFiles(t *testing.T) {
+	dir := writeConfigFiles(t, multiCacheFiles)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	errs, err := ValidateConfig(path, Params{"env": "prod"})
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+
+	errs, err = ValidateConfig(path, Params{})
+	assert.NoError(t, err)
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "caches", "accounts.yml") + `:7: collections[0].maps[0]: name uses param "env", which is not set`,
+	}, msgs)
+
+	errs = validateConfig(path, []byte(`include: ['nope.yml']
+caches:
+  - name: 'a'
+    collections:
+      - collection: 'a'
+        query: '{{template "missing" .}}'
+        maps:
+          - name: 'a'
+            key: '{{.a}}'
+            val: '{{.a}}'
+  - name: 'a'
+`), Params{})
+	msgs = []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		path + ":1: included file " + filepath.Join(dir, "nope.yml") + " does not exist",
+		path + `:6: caches[0].collections[0]: query template invokes template "missing", which is not defined`,
+		path + `:11: caches[1]: duplicate cache name "a", also used by caches[0]`,
+		path + ":11: caches[1]: no collections",
+	}, msgs)
+}